@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"math/big"
+	"strings"
 
 	bert "github.com/kbudde/gobert"
 	log "github.com/sirupsen/logrus"
@@ -44,6 +45,31 @@ func (rep *rabbitBERTReply) MakeStatsInfo(labels []string) []StatsInfo {
 	return statistics
 }
 
+func (rep *rabbitBERTReply) MakePage(labels []string) ([]StatsInfo, int) {
+	var items bert.Term
+	itemsFound := false
+	pageCount := 0
+	err := iterateBertKV(rep.objects, func(key string, value interface{}) bool {
+		switch key {
+		case "items":
+			items = value
+			itemsFound = true
+		case "page_count":
+			if count, ok := parseFloaty(value); ok {
+				pageCount = int(count)
+			}
+		}
+		return true
+	})
+	if err != nil || !itemsFound {
+		log.WithField("got", rep.objects).Error("Paginated reply should contain a list of items")
+		return make([]StatsInfo, 0), 0
+	}
+
+	page := &rabbitBERTReply{nil, items}
+	return page.MakeStatsInfo(labels), pageCount
+}
+
 func (rep *rabbitBERTReply) MakeMap() MetricMap {
 	flMap := make(MetricMap)
 	term := rep.objects
@@ -112,6 +138,9 @@ func parseSingleStatsObject(obj interface{}, labels []string) (*StatsInfo, bool)
 		for _, label := range labels {
 			if key == label {
 				tmp, ok := parseBertStringy(value)
+				if !ok {
+					tmp, ok = parseBertStringList(value)
+				}
 				if !ok {
 					log.WithField("got", value).WithField("label", label).Error("Non-string field")
 					objectOk = false
@@ -121,6 +150,10 @@ func parseSingleStatsObject(obj interface{}, labels []string) (*StatsInfo, bool)
 			}
 		}
 
+		if namedLists[key] {
+			parseNamedList(&result.metrics, key, value)
+		}
+
 		arr, isSlice := assertBertSlice(value)
 		_, iSPropList := assertBertProplistPairs(value)
 
@@ -144,10 +177,41 @@ func parseSingleStatsObject(obj interface{}, labels []string) (*StatsInfo, bool)
 		}
 		return true
 	})
-	if err == nil && objectOk {
-		return &result, true
+	if err != nil || !objectOk {
+		return nil, false
 	}
-	return nil, false
+
+	//Labels of nested objects use '.'-separated keys
+	for _, label := range labels {
+		if !strings.Contains(label, ".") {
+			continue
+		}
+		if value, ok := lookupBertPath(obj, label); ok {
+			if tmp, ok := parseBertStringy(value); ok {
+				result.labels[label] = tmp
+			} else if tmp, ok := parseBertStringList(value); ok {
+				result.labels[label] = tmp
+			}
+		}
+	}
+	return &result, true
+}
+
+// lookupBertPath returns the value of a nested map-like structure
+// by its '.'-separated path. Keys can contain dots as well (e.g.
+// node names), so the path is matched key by key.
+func lookupBertPath(obj interface{}, path string) (interface{}, bool) {
+	var result interface{}
+	found := false
+	iterateBertKV(obj, func(key string, value interface{}) bool {
+		if key == path {
+			result, found = value, true
+		} else if strings.HasPrefix(path, key+".") {
+			result, found = lookupBertPath(value, strings.TrimPrefix(path, key+"."))
+		}
+		return !found
+	})
+	return result, found
 }
 
 // parseProplist descends into an erlang data structure and stores
@@ -171,6 +235,23 @@ func parseProplist(toMap *MetricMap, basename string, maybeProplist interface{})
 	})
 }
 
+// parseNamedList stores the numeric values of a list of named
+// objects in a toMap. The keys are prefixed with basename and the
+// name of the object, like the named lists of the JSON parser.
+func parseNamedList(toMap *MetricMap, basename string, maybeList interface{}) {
+	items, ok := assertBertSlice(maybeList)
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		name := ""
+		if value, ok := lookupBertPath(item, "name"); ok {
+			name, _ = parseBertStringy(value)
+		}
+		parseProplist(toMap, basename+"."+name, item) // This can fail, but we don't care
+	}
+}
+
 // assertBertSlice checks whether the provided value is something
 // that's represented as a slice by BERT parcer (list or tuple).
 func assertBertSlice(maybeSlice interface{}) ([]bert.Term, bool) {
@@ -304,6 +385,25 @@ func parseBertStringy(val interface{}) (string, bool) {
 	return "", false
 }
 
+// parseBertStringList tries to interpret the provided BERT value as
+// a list of strings. The strings are joined comma-separated, like
+// the lists of strings of the JSON parser.
+func parseBertStringList(val interface{}) (string, bool) {
+	list, ok := assertBertSlice(val)
+	if !ok {
+		return "", false
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := parseBertStringy(item)
+		if !ok {
+			return "", false
+		}
+		values = append(values, s)
+	}
+	return strings.Join(values, ","), true
+}
+
 type bertDecodeError struct {
 	message string
 	object  interface{}
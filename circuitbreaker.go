@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	circuitOpenDesc = newDesc("exporter_api_circuit_open", "Is the circuit breaker for the management api endpoint open. Requests to an open endpoint are skipped until the cooldown is over.", []string{"endpoint"})
+
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = make(map[string]*targetBreakers) // rabbitURL -> breakers of the endpoints
+)
+
+//circuitBreakerRetention is the time the breakers of a target are kept after its last request.
+//Probed targets which are not scraped anymore are forgotten.
+const circuitBreakerRetention = time.Hour
+
+type targetBreakers struct {
+	endpoints map[string]*circuitBreaker
+	lastUsed  time.Time
+}
+
+//circuitBreaker stops querying an endpoint after threshold consecutive failures.
+//After the cooldown a single request is let through. If it succeeds the circuit is closed again.
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+//getCircuitBreaker returns the breaker of the endpoint. Query parameters are not part of the key.
+func getCircuitBreaker(rabbitURL, endpoint string) *circuitBreaker {
+	endpoint = strings.SplitN(endpoint, "?", 2)[0]
+
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	now := time.Now()
+	for url, target := range circuitBreakers {
+		if now.Sub(target.lastUsed) > circuitBreakerRetention {
+			delete(circuitBreakers, url)
+		}
+	}
+	target, ok := circuitBreakers[rabbitURL]
+	if !ok {
+		target = &targetBreakers{endpoints: make(map[string]*circuitBreaker)}
+		circuitBreakers[rabbitURL] = target
+	}
+	target.lastUsed = now
+	breaker, ok := target.endpoints[endpoint]
+	if !ok {
+		breaker = &circuitBreaker{}
+		target.endpoints[endpoint] = breaker
+	}
+	return breaker
+}
+
+//allow returns false while the circuit is open and the cooldown is not over
+func (b *circuitBreaker) allow(cooldown time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < cooldown {
+		return false
+	}
+	b.probing = true // half open: only one request tests the endpoint
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.open = false
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure(threshold int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.probing || b.failures >= threshold {
+		if !b.open {
+			log.WithField("failures", b.failures).Warn("Opening circuit breaker")
+		}
+		b.open = true
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+//release ends a probe without a result. The next request after the cooldown probes again.
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.open
+}
+
+//collectCircuitBreakers exports the state of all breakers of the scraped rabbitmq
+func collectCircuitBreakers(ctx context.Context, rabbitURL string, ch chan<- prometheus.Metric) {
+	circuitBreakersMu.Lock()
+	states := make(map[string]float64)
+	if target, ok := circuitBreakers[rabbitURL]; ok {
+		for endpoint, breaker := range target.endpoints {
+			states[endpoint] = 0
+			if breaker.isOpen() {
+				states[endpoint] = 1
+			}
+		}
+	}
+	circuitBreakersMu.Unlock()
+
+	for endpoint, open := range states {
+		ch <- mustNewConstMetric(&ctx, circuitOpenDesc, prometheus.GaugeValue, open, endpoint)
+	}
+}
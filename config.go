@@ -14,27 +14,50 @@ import (
 var (
 	config        rabbitExporterConfig
 	defaultConfig = rabbitExporterConfig{
-		RabbitURL:          "http://127.0.0.1:15672",
-		RabbitUsername:     "guest",
-		RabbitPassword:     "guest",
-		PublishPort:        "9419",
-		PublishAddr:        "",
-		OutputFormat:       "TTY", //JSON
-		CAFile:             "ca.pem",
-		CertFile:           "client-cert.pem",
-		KeyFile:            "client-key.pem",
-		InsecureSkipVerify: false,
-		ExcludeMetrics:     []string{},
-		SkipQueues:         regexp.MustCompile("^$"),
-		IncludeQueues:      regexp.MustCompile(".*"),
-		SkipVHost:          regexp.MustCompile("^$"),
-		IncludeVHost:       regexp.MustCompile(".*"),
-		RabbitCapabilities: parseCapabilities("no_sort,bert"),
-		EnabledExporters:   []string{"exchange", "node", "overview", "queue"},
-		Timeout:            30,
-		MaxQueues:          0,
-		SubSystemName:      "",
-		SubSystemID:        "",
+		RabbitURL:               "http://127.0.0.1:15672",
+		RabbitUsername:          "guest",
+		RabbitPassword:          "guest",
+		PublishPort:             "9419",
+		PublishAddr:             "",
+		OutputFormat:            "TTY", //JSON
+		CAFile:                  "ca.pem",
+		CertFile:                "client-cert.pem",
+		KeyFile:                 "client-key.pem",
+		InsecureSkipVerify:      false,
+		ExcludeMetrics:          []string{},
+		SkipQueues:              regexp.MustCompile("^$"),
+		IncludeQueues:           regexp.MustCompile(".*"),
+		SkipVHost:               regexp.MustCompile("^$"),
+		IncludeVHost:            regexp.MustCompile(".*"),
+		SkipExchanges:           regexp.MustCompile("^$"),
+		IncludeExchanges:        regexp.MustCompile(".*"),
+		RabbitCapabilities:      parseCapabilities("no_sort,bert"),
+		EnabledExporters:        []string{"exchange", "node", "overview", "queue"},
+		Timeout:                 30,
+		MaxQueues:               0,
+		ModuleConcurrency:       0,
+		ScrapeInterval:          0,
+		ModuleTimeouts:          map[string]int{},
+		APIRetries:              0,
+		APIRetryBackoff:         200,
+		CircuitBreakerThreshold: 0,
+		CircuitBreakerCooldown:  60,
+		StaleMaxAge:             0,
+		StaleFile:               "",
+		PageSize:                0,
+		ChannelAggregation:      "channel",
+		ConsumerConnectionName:  false,
+		ConnectionClientLabels:  []string{},
+		ConnectionAggregation:   "peer_host",
+		HealthCertExpiration:    "1/months",
+		HealthPorts:             []string{"5672"},
+		HealthProtocols:         []string{"amqp091"},
+		NodeMemory:              false,
+		ExpectedNodes:           []string{},
+		FederationCoverage:      false,
+		ProbeTargets:            []string{},
+		SubSystemName:           "",
+		SubSystemID:             "",
 		//ExtraLabels:		[]map[string]string{},
 	}
 )
@@ -55,15 +78,40 @@ type rabbitExporterConfig struct {
 	IncludeQueues            *regexp.Regexp      `json:"-"`
 	SkipVHost                *regexp.Regexp      `json:"-"`
 	IncludeVHost             *regexp.Regexp      `json:"-"`
+	SkipExchanges            *regexp.Regexp      `json:"-"`
+	IncludeExchanges         *regexp.Regexp      `json:"-"`
 	IncludeQueuesString      string              `json:"include_queues"`
 	SkipQueuesString         string              `json:"skip_queues"`
 	SkipVHostString          string              `json:"skip_vhost"`
 	IncludeVHostString       string              `json:"include_vhost"`
+	SkipExchangesString      string              `json:"skip_exchanges"`
+	IncludeExchangesString   string              `json:"include_exchanges"`
 	RabbitCapabilitiesString string              `json:"rabbit_capabilities"`
 	RabbitCapabilities       rabbitCapabilitySet `json:"-"`
 	EnabledExporters         []string            `json:"enabled_exporters"`
 	Timeout                  int                 `json:"timeout"`
 	MaxQueues                int                 `json:"max_queues"`
+	ModuleConcurrency        int                 `json:"module_concurrency"`
+	ScrapeInterval           int                 `json:"scrape_interval"`
+	ModuleTimeouts           map[string]int      `json:"module_timeouts"`
+	APIRetries               int                 `json:"api_retries"`
+	APIRetryBackoff          int                 `json:"api_retry_backoff"`
+	CircuitBreakerThreshold  int                 `json:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown   int                 `json:"circuit_breaker_cooldown"`
+	StaleMaxAge              int                 `json:"stale_max_age"`
+	StaleFile                string              `json:"stale_file"`
+	PageSize                 int                 `json:"page_size"`
+	ChannelAggregation       string              `json:"channel_aggregation"`
+	ConsumerConnectionName   bool                `json:"consumer_connection_name"`
+	ConnectionClientLabels   []string            `json:"connection_client_labels"`
+	ConnectionAggregation    string              `json:"connection_aggregation"`
+	HealthCertExpiration     string              `json:"health_cert_expiration"`
+	HealthPorts              []string            `json:"health_ports"`
+	HealthProtocols          []string            `json:"health_protocols"`
+	NodeMemory               bool                `json:"node_memory"`
+	ExpectedNodes            []string            `json:"expected_nodes"`
+	FederationCoverage       bool                `json:"federation_coverage"`
+	ProbeTargets             []string            `json:"probe_targets"`
 	SubSystemName            string              `json:"sub_system_name"`
 	SubSystemID              string              `json:"sub_system_id"`
 	//ExtraLabels              []map[string]string `json:"extra_labels"`
@@ -73,13 +121,15 @@ type rabbitCapability string
 type rabbitCapabilitySet map[rabbitCapability]bool
 
 const (
-	rabbitCapNoSort rabbitCapability = "no_sort"
-	rabbitCapBert   rabbitCapability = "bert"
+	rabbitCapNoSort  rabbitCapability = "no_sort"
+	rabbitCapBert    rabbitCapability = "bert"
+	rabbitCapColumns rabbitCapability = "columns"
 )
 
 var allRabbitCapabilities = rabbitCapabilitySet{
-	rabbitCapNoSort: true,
-	rabbitCapBert:   true,
+	rabbitCapNoSort:  true,
+	rabbitCapBert:    true,
+	rabbitCapColumns: true,
 }
 
 func initConfigFromFile(config_file string) error {
@@ -99,7 +149,40 @@ func initConfigFromFile(config_file string) error {
 	config.IncludeQueues = regexp.MustCompile(config.IncludeQueuesString)
 	config.SkipVHost = regexp.MustCompile(config.SkipVHostString)
 	config.IncludeVHost = regexp.MustCompile(config.IncludeVHostString)
+	if config.SkipExchangesString == "" { // config files without skip_exchanges export all exchanges
+		config.SkipExchangesString = "^$"
+	}
+	config.SkipExchanges = regexp.MustCompile(config.SkipExchangesString)
+	config.IncludeExchanges = regexp.MustCompile(config.IncludeExchangesString)
 	config.RabbitCapabilities = parseCapabilities(config.RabbitCapabilitiesString)
+
+	// config files without the aggregation settings use the defaults of the environment configuration
+	if config.ChannelAggregation == "" {
+		config.ChannelAggregation = defaultConfig.ChannelAggregation
+	}
+	if config.ConnectionAggregation == "" {
+		config.ConnectionAggregation = defaultConfig.ConnectionAggregation
+	}
+	checkAggregationConfig(&config)
+
+	// config files without the retry backoff or the circuit breaker cooldown use the defaults of the environment configuration
+	if config.APIRetryBackoff == 0 {
+		config.APIRetryBackoff = defaultConfig.APIRetryBackoff
+	}
+	if config.CircuitBreakerCooldown == 0 {
+		config.CircuitBreakerCooldown = defaultConfig.CircuitBreakerCooldown
+	}
+
+	// the health checks use the defaults if they are missing, an empty list disables the port and protocol checks
+	if config.HealthCertExpiration == "" {
+		config.HealthCertExpiration = defaultConfig.HealthCertExpiration
+	}
+	if config.HealthPorts == nil {
+		config.HealthPorts = defaultConfig.HealthPorts
+	}
+	if config.HealthProtocols == nil {
+		config.HealthProtocols = defaultConfig.HealthProtocols
+	}
 	return nil
 }
 
@@ -193,6 +276,14 @@ func initConfig() {
 		config.IncludeVHost = regexp.MustCompile(IncludeVHost)
 	}
 
+	if SkipExchanges := os.Getenv("SKIP_EXCHANGES"); SkipExchanges != "" {
+		config.SkipExchanges = regexp.MustCompile(SkipExchanges)
+	}
+
+	if IncludeExchanges := os.Getenv("INCLUDE_EXCHANGES"); IncludeExchanges != "" {
+		config.IncludeExchanges = regexp.MustCompile(IncludeExchanges)
+	}
+
 	if rawCapabilities := os.Getenv("RABBIT_CAPABILITIES"); rawCapabilities != "" {
 		config.RabbitCapabilities = parseCapabilities(rawCapabilities)
 	}
@@ -217,6 +308,126 @@ func initConfig() {
 		config.MaxQueues = m
 	}
 
+	if moduleConcurrency := os.Getenv("MODULE_CONCURRENCY"); moduleConcurrency != "" {
+		c, err := strconv.Atoi(moduleConcurrency)
+		if err != nil {
+			panic(fmt.Errorf("moduleConcurrency is not a number: %v", err))
+		}
+		config.ModuleConcurrency = c
+	}
+
+	if scrapeInterval := os.Getenv("SCRAPE_INTERVAL"); scrapeInterval != "" {
+		i, err := strconv.Atoi(scrapeInterval)
+		if err != nil {
+			panic(fmt.Errorf("scrapeInterval is not a number: %v", err))
+		}
+		config.ScrapeInterval = i
+	}
+
+	if moduleTimeouts := os.Getenv("MODULE_TIMEOUTS"); moduleTimeouts != "" {
+		config.ModuleTimeouts = parseModuleTimeouts(moduleTimeouts)
+	}
+
+	if retries := os.Getenv("RABBIT_RETRIES"); retries != "" {
+		r, err := strconv.Atoi(retries)
+		if err != nil {
+			panic(fmt.Errorf("retries is not a number: %v", err))
+		}
+		config.APIRetries = r
+	}
+
+	if retryBackoff := os.Getenv("RABBIT_RETRY_BACKOFF"); retryBackoff != "" {
+		b, err := strconv.Atoi(retryBackoff)
+		if err != nil {
+			panic(fmt.Errorf("retryBackoff is not a number: %v", err))
+		}
+		config.APIRetryBackoff = b
+	}
+
+	if threshold := os.Getenv("CIRCUIT_BREAKER_THRESHOLD"); threshold != "" {
+		t, err := strconv.Atoi(threshold)
+		if err != nil {
+			panic(fmt.Errorf("circuitBreakerThreshold is not a number: %v", err))
+		}
+		config.CircuitBreakerThreshold = t
+	}
+
+	if cooldown := os.Getenv("CIRCUIT_BREAKER_COOLDOWN"); cooldown != "" {
+		c, err := strconv.Atoi(cooldown)
+		if err != nil {
+			panic(fmt.Errorf("circuitBreakerCooldown is not a number: %v", err))
+		}
+		config.CircuitBreakerCooldown = c
+	}
+
+	if staleMaxAge := os.Getenv("STALE_MAX_AGE"); staleMaxAge != "" {
+		a, err := strconv.Atoi(staleMaxAge)
+		if err != nil {
+			panic(fmt.Errorf("staleMaxAge is not a number: %v", err))
+		}
+		config.StaleMaxAge = a
+	}
+
+	if staleFile := os.Getenv("STALE_FILE"); staleFile != "" {
+		config.StaleFile = staleFile
+	}
+
+	if pageSize := os.Getenv("PAGE_SIZE"); pageSize != "" {
+		p, err := strconv.Atoi(pageSize)
+		if err != nil {
+			panic(fmt.Errorf("pageSize is not a number: %v", err))
+		}
+		config.PageSize = p
+	}
+
+	if channelAggregation := os.Getenv("CHANNEL_AGGREGATION"); channelAggregation != "" {
+		config.ChannelAggregation = channelAggregation
+	}
+
+	if consumerConnectionName := os.Getenv("CONSUMER_CONNECTION_NAME"); consumerConnectionName == "true" || consumerConnectionName == "1" || consumerConnectionName == "TRUE" {
+		config.ConsumerConnectionName = true
+	}
+
+	if clientLabels := os.Getenv("CONNECTION_CLIENT_LABELS"); clientLabels != "" {
+		config.ConnectionClientLabels = strings.Split(clientLabels, ",")
+	}
+
+	if connectionAggregation := os.Getenv("CONNECTION_AGGREGATION"); connectionAggregation != "" {
+		config.ConnectionAggregation = connectionAggregation
+	}
+	checkAggregationConfig(&config)
+
+	if certificateExpiration := os.Getenv("HEALTH_CERT_EXPIRATION"); certificateExpiration != "" {
+		config.HealthCertExpiration = certificateExpiration
+	}
+
+	if ports := os.Getenv("HEALTH_PORTS"); ports != "" {
+		config.HealthPorts = strings.Split(ports, ",")
+	}
+
+	if protocols := os.Getenv("HEALTH_PROTOCOLS"); protocols != "" {
+		config.HealthProtocols = strings.Split(protocols, ",")
+	}
+
+	if nodeMemory := os.Getenv("NODE_MEMORY"); nodeMemory == "true" || nodeMemory == "1" || nodeMemory == "TRUE" {
+		config.NodeMemory = true
+	}
+
+	if expectedNodes := os.Getenv("EXPECTED_NODES"); expectedNodes != "" {
+		config.ExpectedNodes = strings.Split(expectedNodes, ",")
+	}
+
+	if federationCoverage := os.Getenv("FEDERATION_COVERAGE"); federationCoverage == "true" || federationCoverage == "1" || federationCoverage == "TRUE" {
+		config.FederationCoverage = true
+	}
+
+	if probeTargets := os.Getenv("PROBE_TARGETS"); probeTargets != "" {
+		config.ProbeTargets = nil
+		for _, target := range strings.Split(probeTargets, ",") {
+			config.ProbeTargets = append(config.ProbeTargets, strings.TrimSpace(target))
+		}
+	}
+
 	if subSystemName := os.Getenv("SUB_SYSTEM_NAME"); subSystemName != "" {
 		config.SubSystemName = subSystemName
 	}
@@ -226,6 +437,35 @@ func initConfig() {
 	}
 }
 
+//checkAggregationConfig trims the connection client labels and panics if an aggregation level or a client label is not supported
+func checkAggregationConfig(c *rabbitExporterConfig) {
+	if !isValidAggregation(c.ChannelAggregation, channelAggregations) {
+		panic(fmt.Errorf("channelAggregation is not one of %v: %v", channelAggregations, c.ChannelAggregation))
+	}
+	if !isValidAggregation(c.ConnectionAggregation, connectionAggregations) {
+		panic(fmt.Errorf("connectionAggregation is not one of %v: %v", connectionAggregations, c.ConnectionAggregation))
+	}
+	labels := make([]string, 0, len(c.ConnectionClientLabels))
+	for _, label := range c.ConnectionClientLabels {
+		label = strings.TrimSpace(label)
+		if connectionClientLabel(label) < 0 {
+			panic(fmt.Errorf("connectionClientLabels is not one of %v: %v", connectionClientLabels, label))
+		}
+		labels = append(labels, label)
+	}
+	c.ConnectionClientLabels = labels
+}
+
+//isValidAggregation checks if aggregation is one of the supported aggregation levels
+func isValidAggregation(aggregation string, levels []string) bool {
+	for _, level := range levels {
+		if aggregation == level {
+			return true
+		}
+	}
+	return false
+}
+
 func parseCapabilities(raw string) rabbitCapabilitySet {
 	result := make(rabbitCapabilitySet)
 	candidates := strings.Split(raw, ",")
@@ -239,6 +479,23 @@ func parseCapabilities(raw string) rabbitCapabilitySet {
 	return result
 }
 
+//parseModuleTimeouts parses a comma-separated list of module=seconds pairs, e.g. "queue=10,node=5"
+func parseModuleTimeouts(raw string) map[string]int {
+	result := make(map[string]int)
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			panic(fmt.Errorf("module timeout must be in the format module=seconds: %v", pair))
+		}
+		t, err := strconv.Atoi(parts[1])
+		if err != nil {
+			panic(fmt.Errorf("module timeout is not a number: %v", err))
+		}
+		result[strings.TrimSpace(parts[0])] = t
+	}
+	return result
+}
+
 func isCapEnabled(config rabbitExporterConfig, cap rabbitCapability) bool {
 	exists, enabled := config.RabbitCapabilities[cap]
 	return exists && enabled
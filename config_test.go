@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
@@ -179,3 +180,97 @@ func TestConfig_EnabledExporters(t *testing.T) {
 		t.Errorf("Invalid Exporters list. diff\n%v", diff)
 	}
 }
+
+func TestConfig_ModuleTimeouts(t *testing.T) {
+	os.Setenv("MODULE_TIMEOUTS", "queue=10, node=5")
+	defer os.Unsetenv("MODULE_TIMEOUTS")
+	initConfig()
+	expected := map[string]int{"queue": 10, "node": 5}
+	if diff := pretty.Compare(config.ModuleTimeouts, expected); diff != "" {
+		t.Errorf("Invalid module timeouts. diff\n%v", diff)
+	}
+}
+
+func TestConfig_ConnectionClientLabels(t *testing.T) {
+	os.Setenv("CONNECTION_CLIENT_LABELS", "product, version")
+	defer os.Unsetenv("CONNECTION_CLIENT_LABELS")
+	initConfig()
+	expected := []string{"product", "version"}
+	if diff := pretty.Compare(config.ConnectionClientLabels, expected); diff != "" {
+		t.Errorf("Invalid connection client labels. diff\n%v", diff)
+	}
+}
+
+func TestConfig_ConnectionClientLabelsUnknown(t *testing.T) {
+	os.Setenv("CONNECTION_CLIENT_LABELS", "product,client_platform")
+	defer os.Unsetenv("CONNECTION_CLIENT_LABELS")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for the unknown connection client label")
+		}
+	}()
+	initConfig()
+}
+
+//initTestConfigFile reads the configuration from a temporary file with content.
+//The configuration from the environment is restored at the end of the test.
+func initTestConfigFile(t *testing.T, content string) {
+	file, err := ioutil.TempFile("", "rabbitmq_exporter_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(content)
+	file.Close()
+
+	if err := initConfigFromFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(initConfig)
+}
+
+func TestConfigFile_Aggregation(t *testing.T) {
+	initTestConfigFile(t, `{"rabbit_url": "http://localhost:15672", "connection_client_labels": [" product "]}`)
+	if config.ChannelAggregation != "channel" || config.ConnectionAggregation != "peer_host" {
+		t.Errorf("Expected the default aggregations. Found channel=%v, connection=%v", config.ChannelAggregation, config.ConnectionAggregation)
+	}
+	if diff := pretty.Compare(config.ConnectionClientLabels, []string{"product"}); diff != "" {
+		t.Errorf("Invalid connection client labels. diff\n%v", diff)
+	}
+}
+
+func TestConfigFile_RetryDefaults(t *testing.T) {
+	initTestConfigFile(t, `{"rabbit_url": "http://localhost:15672", "api_retries": 2, "circuit_breaker_threshold": 3}`)
+	if config.APIRetryBackoff != 200 || config.CircuitBreakerCooldown != 60 {
+		t.Errorf("Expected the default backoff and cooldown. Found backoff=%v, cooldown=%v", config.APIRetryBackoff, config.CircuitBreakerCooldown)
+	}
+
+	initTestConfigFile(t, `{"rabbit_url": "http://localhost:15672", "api_retry_backoff": 50, "circuit_breaker_cooldown": 10}`)
+	if config.APIRetryBackoff != 50 || config.CircuitBreakerCooldown != 10 {
+		t.Errorf("Expected the configured backoff and cooldown. Found backoff=%v, cooldown=%v", config.APIRetryBackoff, config.CircuitBreakerCooldown)
+	}
+}
+
+func TestConfigFile_HealthDefaults(t *testing.T) {
+	initTestConfigFile(t, `{"rabbit_url": "http://localhost:15672"}`)
+	if config.HealthCertExpiration != "1/months" {
+		t.Errorf("Expected the default certificate expiration. Found %q", config.HealthCertExpiration)
+	}
+	if diff := pretty.Compare(config.HealthPorts, []string{"5672"}); diff != "" {
+		t.Errorf("Expected the default health ports. diff: %v", diff)
+	}
+	if diff := pretty.Compare(config.HealthProtocols, []string{"amqp091"}); diff != "" {
+		t.Errorf("Expected the default health protocols. diff: %v", diff)
+	}
+
+	initTestConfigFile(t, `{"rabbit_url": "http://localhost:15672", "health_cert_expiration": "2/weeks", "health_ports": [], "health_protocols": ["amqp091", "mqtt"]}`)
+	if config.HealthCertExpiration != "2/weeks" {
+		t.Errorf("Expected the configured certificate expiration. Found %q", config.HealthCertExpiration)
+	}
+	if len(config.HealthPorts) != 0 {
+		t.Errorf("Expected no health ports. Found %v", config.HealthPorts)
+	}
+	if diff := pretty.Compare(config.HealthProtocols, []string{"amqp091", "mqtt"}); diff != "" {
+		t.Errorf("Expected the configured health protocols. diff: %v", diff)
+	}
+}
@@ -26,6 +26,12 @@ type RabbitReply interface {
 	// Failure to parse should result in an empty result list.
 	MakeStatsInfo([]string) []StatsInfo
 
+	// MakePage parses a paginated list of named RabbitMQ objects
+	// (a reply to a request with the 'page' parameter). It
+	// returns the objects of the page and the number of pages.
+	// Failure to parse should result in an empty result list.
+	MakePage([]string) ([]StatsInfo, int)
+
 	// GetString returns the string value for the given key
 	// If the key cannot be found the second return is false
 	GetString(key string) (string, bool)
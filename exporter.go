@@ -13,20 +13,24 @@ import (
 var (
 	exportersMu       sync.RWMutex
 	exporterFactories = make(map[string]func() Exporter)
+
+	upDesc                   = newDesc("up", "Was the last scrape of rabbitmq successful.", []string{"cluster", "node"})
+	moduleUpDesc             = newDesc("module_up", "Was the last scrape of rabbitmq successful per module.", []string{"cluster", "node", "module"})
+	moduleScrapeDurationDesc = newDesc("module_scrape_duration_seconds", "Duration of the last scrape in seconds", []string{"cluster", "node", "module"})
 )
 
 type contextValues string
 
 const (
-	endpointScrapeDuration contextValues = "endpointScrapeDuration"
-	endpointUpMetric       contextValues = "endpointUpMetric"
-	nodeName               contextValues = "node"
-	clusterName            contextValues = "cluster"
-	totalQueues            contextValues = "totalQueues"
-	hostInfo               contextValues = "hostInfo"
-	subSystemName          contextValues = "subSystemName"
-	subSystemID            contextValues = "subSystemID"
-	//extraLabels            contextValues = "extraLabels"
+	nodeName        contextValues = "node"
+	clusterName     contextValues = "cluster"
+	totalQueues     contextValues = "totalQueues"
+	rabbitmqVersion contextValues = "rabbitmqVersion"
+	hostInfo        contextValues = "hostInfo"
+	subSystemName   contextValues = "subSystemName"
+	subSystemID     contextValues = "subSystemID"
+	targetConfig    contextValues = "targetConfig"
+	//extraLabels     contextValues = "extraLabels"
 )
 
 //RegisterExporter makes an exporter available by the provided name.
@@ -40,14 +44,14 @@ func RegisterExporter(name string, f func() Exporter) {
 }
 
 type exporter struct {
-	mutex                        sync.RWMutex
-	upMetric                     *prometheus.GaugeVec
-	endpointUpMetric             *prometheus.GaugeVec
-	endpointScrapeDurationMetric *prometheus.GaugeVec
-	exporter                     map[string]Exporter
-	overviewExporter             *exporterOverview
-	self                         string
-	lastScrapeOK                 bool
+	mutex            sync.RWMutex
+	exporter         map[string]Exporter
+	overviewExporter *exporterOverview
+	self             string
+	lastScrapeOK     bool
+	config           rabbitExporterConfig
+	snapshot         *snapshot
+	stale            *staleCache
 }
 
 //Exporter interface for prometheus metrics. Collect is fetching the data and therefore can return an error
@@ -57,26 +61,34 @@ type Exporter interface {
 }
 
 func newExporter() *exporter {
+	e := newTargetExporter(config)
+	if config.StaleMaxAge > 0 {
+		e.stale = newStaleCache(time.Duration(config.StaleMaxAge)*time.Second, config.StaleFile)
+	}
+	return e
+}
+
+//newTargetExporter creates an exporter scraping the rabbitmq described by cfg.
+//Each exporter owns its metrics, so exporters for different targets can be collected concurrently.
+func newTargetExporter(cfg rabbitExporterConfig) *exporter {
 	enabledExporter := make(map[string]Exporter)
-	for _, e := range config.EnabledExporters {
+	for _, e := range cfg.EnabledExporters {
 		if _, ok := exporterFactories[e]; ok {
 			enabledExporter[e] = exporterFactories[e]()
 		}
 	}
 
 	return &exporter{
-		upMetric:                     newGaugeVec("up", "Was the last scrape of rabbitmq successful.", []string{"cluster", "node"}),
-		endpointUpMetric:             newGaugeVec("module_up", "Was the last scrape of rabbitmq successful per module.", []string{"cluster", "node", "module"}),
-		endpointScrapeDurationMetric: newGaugeVec("module_scrape_duration_seconds", "Duration of the last scrape in seconds", []string{"cluster", "node", "module"}),
-		exporter:                     enabledExporter,
-		overviewExporter:             newExporterOverview(),
-		lastScrapeOK:                 true, //return true after start. Value will be updated with each scraping
+		exporter:         enabledExporter,
+		overviewExporter: newExporterOverview(),
+		lastScrapeOK:     true, //return true after start. Value will be updated with each scraping
+		config:           cfg,
 	}
 }
 
 func (e *exporter) LastScrapeOK() bool {
-	e.mutex.Lock() // To protect metrics from concurrent collects.
-	defer e.mutex.Unlock()
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
 	return e.lastScrapeOK
 }
 
@@ -87,36 +99,70 @@ func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
 		ex.Describe(ch)
 	}
 
-	e.upMetric.Describe(ch)
-	e.endpointUpMetric.Describe(ch)
-	e.endpointScrapeDurationMetric.Describe(ch)
+	ch <- upDesc
+	ch <- moduleUpDesc
+	ch <- moduleScrapeDurationDesc
+	ch <- snapshotAgeDesc
+	ch <- circuitOpenDesc
+	ch <- moduleStaleDesc
 	BuildInfo.Describe(ch)
 }
 
 // 实现了prometheus client相关接口的exporter，prometheus会调用这个Collect方法
 // 在该方法内部，在调用各个注册进enabledExporter的对象的Collect方法，然后将ctx传给它们
+// 开启后台抓取时，直接返回最近一次完整抓取的快照
 func (e *exporter) Collect(ch chan<- prometheus.Metric) {
-	// 定义传给各个模块Collect的上下文
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, endpointScrapeDuration, e.endpointScrapeDurationMetric)
-	ctx = context.WithValue(ctx, endpointUpMetric, e.endpointUpMetric)
-	//use last know value, could be outdated or empty
-	ctx = context.WithValue(ctx, nodeName, e.overviewExporter.NodeInfo().Node)
-	ctx = context.WithValue(ctx, clusterName, e.overviewExporter.NodeInfo().ClusterName)
-	ctx = context.WithValue(ctx, totalQueues, e.overviewExporter.NodeInfo().TotalQueues)
+	e.collect(context.Background(), ch)
+}
+
+func (e *exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.snapshot != nil {
+		e.collectSnapshot(ch)
+		return
+	}
+	e.scrape(ctx, ch)
+}
+
+//scrapeCollector binds the collection of an exporter to the context of a single scrape request.
+//Cancellation and deadline of the context are passed to every request to rabbitmq.
+type scrapeCollector struct {
+	*exporter
+	ctx context.Context
+}
+
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collect(c.ctx, ch)
+}
+
+//withContext returns a collector which uses ctx for scraping rabbitmq
+func (e *exporter) withContext(ctx context.Context) prometheus.Collector {
+	return scrapeCollector{e, ctx}
+}
+
+// 定义传给各个模块Collect的上下文
+func (e *exporter) newContext(parent context.Context) context.Context {
+	ctx := parent
+
+	// 抓取目标的配置(RabbitURL等)，/probe 时每个目标各不相同
+	ctx = context.WithValue(ctx, targetConfig, e.config)
 
 	// 新增: 实例信息(IP:PORT)，来自配置文件的RabbitURL
-	ctx = context.WithValue(ctx, hostInfo, strings.Split(config.RabbitURL, "/")[2])
+	ctx = context.WithValue(ctx, hostInfo, strings.Split(e.config.RabbitURL, "/")[2])
 	// 新增: 子系统名称，来自配置文件的SubsystemName
-	ctx = context.WithValue(ctx, subSystemName, config.SubSystemName)
+	ctx = context.WithValue(ctx, subSystemName, e.config.SubSystemName)
 	// 新增: 子系统ID，来自配置文件的SubsystemID
-	ctx = context.WithValue(ctx, subSystemID, config.SubSystemID)
+	ctx = context.WithValue(ctx, subSystemID, e.config.SubSystemID)
 	// 上报的额外标签信息（附加到所有指标之上）
 	//ctx = context.WithValue(ctx, extraLabels, config.ExtraLabels)
+	return ctx
+}
 
-	e.mutex.Lock() // To protect metrics from concurrent collects.
-	defer e.mutex.Unlock()
+//scrape fetches the data of all modules from rabbitmq
+func (e *exporter) scrape(parent context.Context, ch chan<- prometheus.Metric) {
+	ctx := e.newContext(parent)
 
+	// All metrics, including up and module_up, are const metrics of this scrape.
+	// Concurrent scrapes do not share any metric and are not serialized.
 	start := time.Now()
 	allUp := true
 
@@ -125,47 +171,103 @@ func (e *exporter) Collect(ch chan<- prometheus.Metric) {
 		allUp = false
 	}
 
+	//use current values. If overview failed the last known value is used, which could be outdated or empty
+	ctx = context.WithValue(ctx, nodeName, e.overviewExporter.NodeInfo().Node)
+	ctx = context.WithValue(ctx, clusterName, e.overviewExporter.NodeInfo().ClusterName)
+	ctx = context.WithValue(ctx, totalQueues, e.overviewExporter.NodeInfo().TotalQueues)
+	ctx = context.WithValue(ctx, rabbitmqVersion, e.overviewExporter.NodeInfo().RabbitmqVersion)
+
+	// overview has to be finished first as the modules depend on its NodeInfo.
+	// The modules are independent of each other and are collected concurrently.
+	limit := e.config.ModuleConcurrency
+	if limit <= 0 || limit > len(e.exporter) {
+		limit = len(e.exporter)
+	}
+	var wg sync.WaitGroup
+	var upMutex sync.Mutex
+	semaphore := make(chan struct{}, limit)
 	for name, ex := range e.exporter {
-		if err := e.collectWithDuration(ctx, ex, name, ch); err != nil {
-			log.WithError(err).Warn("retrieving " + name + " failed")
-			allUp = false
-		}
+		wg.Add(1)
+		go func(name string, ex Exporter) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if err := e.collectWithDuration(ctx, ex, name, ch); err != nil {
+				log.WithError(err).Warn("retrieving " + name + " failed")
+				upMutex.Lock()
+				allUp = false
+				upMutex.Unlock()
+			}
+		}(name, ex)
 	}
+	wg.Wait()
 
 	BuildInfo.Collect(ch)
+	if e.config.CircuitBreakerThreshold > 0 {
+		collectCircuitBreakers(ctx, e.config.RabbitURL, ch)
+	}
 
+	var up float64
 	if allUp {
-		gaugeVecWithLabelValues(&ctx, e.upMetric, e.overviewExporter.NodeInfo().ClusterName, e.overviewExporter.NodeInfo().Node).Set(1)
-	} else {
-		gaugeVecWithLabelValues(&ctx, e.upMetric, e.overviewExporter.NodeInfo().ClusterName, e.overviewExporter.NodeInfo().Node).Set(0)
+		up = 1
 	}
+	ch <- mustNewConstMetric(&ctx, upDesc, prometheus.GaugeValue, up, e.overviewExporter.NodeInfo().ClusterName, e.overviewExporter.NodeInfo().Node)
+	e.mutex.Lock()
 	e.lastScrapeOK = allUp
-	e.upMetric.Collect(ch)
-	e.endpointUpMetric.Collect(ch)
-	e.endpointScrapeDurationMetric.Collect(ch)
+	e.mutex.Unlock()
+	if e.stale != nil {
+		if err := e.stale.save(); err != nil {
+			log.WithError(err).Warn("Saving stale metrics failed")
+		}
+	}
 	log.WithField("duration", time.Since(start)).Info("Metrics updated")
 
 }
 
 func (e *exporter) collectWithDuration(ctx context.Context, ex Exporter, name string, ch chan<- prometheus.Metric) error {
 	startModule := time.Now()
-	err := ex.Collect(ctx, ch)
+	if timeout, ok := e.config.ModuleTimeouts[name]; ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	var err error
+	stale := false
+	if e.stale != nil {
+		stale, err = e.stale.collect(ctx, name, ex, ch)
+	} else {
+		err = ex.Collect(ctx, ch)
+	}
 
 	//use current data
 	node := e.overviewExporter.NodeInfo().Node
 	cluster := e.overviewExporter.NodeInfo().ClusterName
 
-	if scrapeDuration, ok := ctx.Value(endpointScrapeDuration).(*prometheus.GaugeVec); ok {
-		if cluster != "" && node != "" { //values are not available until first scrape of overview succeeded
-			gaugeVecWithLabelValues(&ctx, scrapeDuration, cluster, node, name).Set(time.Since(startModule).Seconds())
+	if e.stale != nil {
+		var value float64
+		if stale {
+			value = 1
 		}
+		ch <- mustNewConstMetric(&ctx, moduleStaleDesc, prometheus.GaugeValue, value, cluster, node, name)
 	}
-	if up, ok := ctx.Value(endpointUpMetric).(*prometheus.GaugeVec); ok {
-		if err != nil {
-			gaugeVecWithLabelValues(&ctx, up, cluster, node, name).Set(0)
-		} else {
-			gaugeVecWithLabelValues(&ctx, up, cluster, node, name).Set(1)
-		}
+
+	if cluster != "" && node != "" { //values are not available until first scrape of overview succeeded
+		ch <- mustNewConstMetric(&ctx, moduleScrapeDurationDesc, prometheus.GaugeValue, time.Since(startModule).Seconds(), cluster, node, name)
+	}
+	var up float64
+	if err == nil {
+		up = 1
 	}
+	ch <- mustNewConstMetric(&ctx, moduleUpDesc, prometheus.GaugeValue, up, cluster, node, name)
 	return err
 }
+
+//configFromContext returns the configuration of the scraped target.
+//The global config is used if the context does not carry a target configuration.
+func configFromContext(ctx context.Context) rabbitExporterConfig {
+	if cfg, ok := ctx.Value(targetConfig).(rabbitExporterConfig); ok {
+		return cfg
+	}
+	return config
+}
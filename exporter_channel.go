@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterExporter("channel", newExporterChannel)
+}
+
+var (
+	channelLabels            = []string{"cluster", "vhost", "user", "connection", "channel", "self"}
+	channelLabelsStateMetric = []string{"cluster", "vhost", "user", "connection", "channel", "self", "state"}
+	channelLabelKeys         = []string{"vhost", "user", "name", "node", "state"}
+
+	channelGaugeVec = map[string]*prometheus.Desc{
+		"prefetch_count":          newDesc("channel_prefetch_count", "Maximum number of unacknowledged messages per consumer of the channel (0 = unlimited).", channelLabels),
+		"global_prefetch_count":   newDesc("channel_global_prefetch_count", "Maximum number of unacknowledged messages shared by all consumers of the channel (0 = unlimited).", channelLabels),
+		"messages_unacknowledged": newDesc("channel_messages_unacknowledged", "Number of messages delivered via the channel but not yet acknowledged.", channelLabels),
+		"messages_unconfirmed":    newDesc("channel_messages_unconfirmed", "Number of published messages not yet confirmed (confirm mode).", channelLabels),
+		"messages_uncommitted":    newDesc("channel_messages_uncommitted", "Number of messages received in a transaction which is not yet committed.", channelLabels),
+		"acks_uncommitted":        newDesc("channel_acks_uncommitted", "Number of acknowledgements received in a transaction which is not yet committed.", channelLabels),
+		"consumer_count":          newDesc("channel_consumers", "Number of consumers on the channel.", channelLabels),
+	}
+
+	channelStateDesc = newDesc("channel_state", "Number of channels in a certain state aggregated per label combination.", channelLabelsStateMetric)
+)
+
+//channelAggregations are the possible values of CHANNEL_AGGREGATION, from the most to the least detailed
+var channelAggregations = []string{"channel", "connection", "user", "vhost"}
+
+type exporterChannel struct {
+	channelMetricsG map[string]*prometheus.Desc
+}
+
+//channelLabelValues are the label values a channel metric is aggregated by
+type channelLabelValues struct {
+	vhost, user, connection, channel, self, state string
+}
+
+func newExporterChannel() Exporter {
+	return exporterChannel{
+		channelMetricsG: withoutExcludedMetrics(channelGaugeVec),
+	}
+}
+
+func (e exporterChannel) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	config := configFromContext(ctx)
+	selfNode := ""
+	if n, ok := ctx.Value(nodeName).(string); ok {
+		selfNode = n
+	}
+	cluster := ""
+	if n, ok := ctx.Value(clusterName).(string); ok {
+		cluster = n
+	}
+
+	// channels with the same labels are summed up
+	gauges := make(map[string]map[channelLabelValues]float64, len(e.channelMetricsG))
+	states := make(map[channelLabelValues]float64)
+	err := forEachPagedStatsInfo(ctx, config, "channels", channelLabelKeys, "", e.columns(), func(channel StatsInfo) {
+		self := "0"
+		if channel.labels["node"] == selfNode {
+			self = "1"
+		}
+		labels := aggregateChannel(config.ChannelAggregation, channelLabelValues{
+			vhost:      channel.labels["vhost"],
+			user:       channel.labels["user"],
+			connection: channelConnectionName(channel.labels["name"]),
+			channel:    channel.labels["name"],
+			self:       self,
+		})
+
+		for key := range e.channelMetricsG {
+			if value, ok := channel.metrics[key]; ok {
+				if gauges[key] == nil {
+					gauges[key] = make(map[channelLabelValues]float64)
+				}
+				gauges[key][labels] += value
+			}
+		}
+
+		labels.state = channel.labels["state"]
+		states[labels]++
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, values := range gauges {
+		for l, value := range values {
+			ch <- mustNewConstMetric(&ctx, e.channelMetricsG[key], prometheus.GaugeValue, value, cluster, l.vhost, l.user, l.connection, l.channel, l.self)
+		}
+	}
+	for l, value := range states {
+		ch <- mustNewConstMetric(&ctx, channelStateDesc, prometheus.GaugeValue, value, cluster, l.vhost, l.user, l.connection, l.channel, l.self, l.state)
+	}
+	return nil
+}
+
+//aggregateChannel clears the labels which are more detailed than the aggregation level
+func aggregateChannel(aggregation string, labels channelLabelValues) channelLabelValues {
+	switch aggregation {
+	case "connection":
+		labels.channel = ""
+	case "user":
+		labels.channel, labels.connection = "", ""
+	case "vhost":
+		labels.channel, labels.connection, labels.user = "", "", ""
+	}
+	return labels
+}
+
+//channelConnectionName returns the name of the connection of a channel. Channels are named "<connection> (<number>)".
+func channelConnectionName(channel string) string {
+	if i := strings.LastIndex(channel, " ("); i >= 0 {
+		return channel[:i]
+	}
+	return channel
+}
+
+//columns returns the fields of a channel needed for the enabled metrics
+func (e exporterChannel) columns() []string {
+	columns := append([]string{}, channelLabelKeys...)
+	for key := range e.channelMetricsG {
+		columns = append(columns, key)
+	}
+	return columns
+}
+
+func (e exporterChannel) Describe(ch chan<- *prometheus.Desc) {
+	for _, channelMetric := range e.channelMetricsG {
+		ch <- channelMetric
+	}
+	ch <- channelStateDesc
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -15,49 +16,96 @@ var (
 	connectionLabelsStateMetric = []string{"cluster", "vhost", "node", "peer_host", "user", "state", "self"}
 	connectionLabelKeys         = []string{"vhost", "node", "peer_host", "user", "state", "node"}
 
-	connectionGaugeVec = map[string]*prometheus.GaugeVec{
-		"channels":  newGaugeVec("connection_channels", "number of channels in use", connectionLabels),
-		"recv_oct":  newGaugeVec("connection_received_bytes", "received bytes", connectionLabels),
-		"recv_cnt":  newGaugeVec("connection_received_packets", "received packets", connectionLabels),
-		"send_oct":  newGaugeVec("connection_send_bytes", "send bytes", connectionLabels),
-		"send_cnt":  newGaugeVec("connection_send_packets", "send packets", connectionLabels),
-		"send_pend": newGaugeVec("connection_send_pending", "Send queue size", connectionLabels),
+	//connectionGauges maps the keys of a connection to the name and help of the gauge. The descriptions depend on CONNECTION_CLIENT_LABELS.
+	connectionGauges = map[string]struct{ name, help string }{
+		"channels":  {"connection_channels", "number of channels in use"},
+		"recv_oct":  {"connection_received_bytes", "received bytes"},
+		"recv_cnt":  {"connection_received_packets", "received packets"},
+		"send_oct":  {"connection_send_bytes", "send bytes"},
+		"send_cnt":  {"connection_send_packets", "send packets"},
+		"send_pend": {"connection_send_pending", "Send queue size"},
 	}
+
+	//connectionChannelBuckets are the buckets of the histogram of the channels per connection
+	connectionChannelBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000}
+
+	//connectionClientLabels are the possible values of CONNECTION_CLIENT_LABELS
+	connectionClientLabels = [...]string{"product", "version", "platform", "connection_name", "protocol", "auth_mechanism", "ssl_protocol"}
+	//connectionClientLabelKeys are the keys of the client labels, in the order of connectionClientLabels
+	connectionClientLabelKeys = [len(connectionClientLabels)]string{"client_properties.product", "client_properties.version", "client_properties.platform", "client_properties.connection_name", "protocol", "auth_mechanism", "ssl_protocol"}
 )
 
+//connectionAggregations are the possible values of CONNECTION_AGGREGATION, from the most to the least detailed. vhost and node are independent of each other
+var connectionAggregations = []string{"per_connection", "peer_host", "user", "vhost", "node"}
+
 type exporterConnections struct {
-	connectionMetricsG map[string]*prometheus.GaugeVec
-	stateMetric        *prometheus.GaugeVec
+	connectionMetricsG map[string]*prometheus.Desc
+	connectionOpened   *prometheus.Desc
+	connectionChannels *prometheus.Desc
+	connectionState    *prometheus.Desc
+	clientLabels       []int // indices of the enabled connectionClientLabels
+	labelKeys          []string
+	perConnection      bool
 }
 
-func newExporterConnections() Exporter {
-	connectionGaugeVecActual := connectionGaugeVec
+//connectionLabelValues are the label values a connection metric is aggregated by
+type connectionLabelValues struct {
+	vhost, node, peerHost, user, state, self, connection string
+	client                                               [len(connectionClientLabels)]string
+}
 
-	if len(config.ExcludeMetrics) > 0 {
-		for _, metric := range config.ExcludeMetrics {
-			if connectionGaugeVecActual[metric] != nil {
-				delete(connectionGaugeVecActual, metric)
-			}
+//connectionChannelHistogram is the histogram of the channels of the connections of a label combination
+type connectionChannelHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+func newExporterConnections() Exporter {
+	// the client labels and the connection label are optional, so the descriptions depend on the configuration
+	var clientLabels []int
+	var optionalLabels []string
+	labelKeys := append([]string{}, connectionLabelKeys...)
+	for _, label := range config.ConnectionClientLabels {
+		i := connectionClientLabel(label)
+		if i < 0 {
+			panic(fmt.Errorf("connectionClientLabels is not one of %v: %v", connectionClientLabels, label))
 		}
+		clientLabels = append(clientLabels, i)
+		optionalLabels = append(optionalLabels, label)
+		labelKeys = append(labelKeys, connectionClientLabelKeys[i])
+	}
+	perConnection := config.ConnectionAggregation == "per_connection"
+	if perConnection {
+		optionalLabels = append(optionalLabels, "connection")
+		labelKeys = append(labelKeys, "name")
+	}
+	labels := append(append([]string{}, connectionLabels...), optionalLabels...)
+	stateLabels := append(append([]string{}, connectionLabelsStateMetric...), optionalLabels...)
+
+	connectionGaugeDescs := make(map[string]*prometheus.Desc, len(connectionGauges))
+	for key, gauge := range connectionGauges {
+		connectionGaugeDescs[key] = newDesc(gauge.name, gauge.help, labels)
 	}
+	// the timestamp and the histogram can be excluded like the gauges
+	optionalDescs := withoutExcludedMetrics(map[string]*prometheus.Desc{
+		"connected_at":            newDesc("connection_opened_timestamp_seconds", "Unix timestamp of the oldest connection of the label combination.", labels),
+		"channels_per_connection": newDesc("connection_channels_per_connection", "Histogram of the number of channels per connection of the label combination.", labels),
+	})
 
 	return exporterConnections{
-		connectionMetricsG: connectionGaugeVecActual,
-		stateMetric:        newGaugeVec("connection_status", "Number of connections in a certain state aggregated per label combination.", connectionLabelsStateMetric),
+		connectionMetricsG: withoutExcludedMetrics(connectionGaugeDescs),
+		connectionOpened:   optionalDescs["connected_at"],
+		connectionChannels: optionalDescs["channels_per_connection"],
+		connectionState:    newDesc("connection_status", "Number of connections in a certain state aggregated per label combination.", stateLabels),
+		clientLabels:       clientLabels,
+		labelKeys:          labelKeys,
+		perConnection:      perConnection,
 	}
 }
 
 func (e exporterConnections) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	rabbitConnectionResponses, err := getStatsInfo(config, "connections", connectionLabelKeys)
-
-	if err != nil {
-		return err
-	}
-	for _, gauge := range e.connectionMetricsG {
-		gauge.Reset()
-	}
-	e.stateMetric.Reset()
-
+	config := configFromContext(ctx)
 	selfNode := ""
 	if n, ok := ctx.Value(nodeName).(string); ok {
 		selfNode = n
@@ -67,36 +115,154 @@ func (e exporterConnections) Collect(ctx context.Context, ch chan<- prometheus.M
 		cluster = n
 	}
 
-	for key, gauge := range e.connectionMetricsG {
-		for _, connD := range rabbitConnectionResponses {
+	// connections with the same labels are summed up
+	gauges := make(map[string]map[connectionLabelValues]float64, len(e.connectionMetricsG))
+	opened := make(map[connectionLabelValues]float64)
+	channels := make(map[connectionLabelValues]*connectionChannelHistogram)
+	states := make(map[connectionLabelValues]float64)
+	err := forEachPagedStatsInfo(ctx, config, "connections", e.labelKeys, "", e.columns(), func(connD StatsInfo) {
+		self := "0"
+		if connD.labels["node"] == selfNode {
+			self = "1"
+		}
+		labels := connectionLabelValues{
+			vhost:      connD.labels["vhost"],
+			node:       connD.labels["node"],
+			peerHost:   connD.labels["peer_host"],
+			user:       connD.labels["user"],
+			self:       self,
+			connection: connD.labels["name"],
+		}
+		for _, i := range e.clientLabels {
+			labels.client[i] = connD.labels[connectionClientLabelKeys[i]]
+		}
+		labels = aggregateConnection(config.ConnectionAggregation, labels)
+
+		for key := range e.connectionMetricsG {
 			if value, ok := connD.metrics[key]; ok {
-				self := "0"
-				if connD.labels["node"] == selfNode {
-					self = "1"
+				if gauges[key] == nil {
+					gauges[key] = make(map[connectionLabelValues]float64)
 				}
-				gaugeVecWithLabelValues(&ctx, gauge, cluster, connD.labels["vhost"], connD.labels["node"], connD.labels["peer_host"], connD.labels["user"], self).Add(value)
+				gauges[key][labels] += value
+			}
+		}
+		// connected_at is in milliseconds. The oldest connection is exported.
+		if connectedAt, ok := connD.metrics["connected_at"]; ok && e.connectionOpened != nil {
+			if oldest, ok := opened[labels]; !ok || connectedAt/1000 < oldest {
+				opened[labels] = connectedAt / 1000
+			}
+		}
+		if value, ok := connD.metrics["channels"]; ok && e.connectionChannels != nil {
+			histogram := channels[labels]
+			if histogram == nil {
+				histogram = &connectionChannelHistogram{buckets: make(map[float64]uint64, len(connectionChannelBuckets))}
+				channels[labels] = histogram
 			}
+			histogram.observe(value)
 		}
+
+		labels.state = connD.labels["state"]
+		states[labels]++
+	})
+	if err != nil {
+		return err
 	}
 
-	for _, connD := range rabbitConnectionResponses {
-		self := "0"
-		if connD.labels["node"] == selfNode {
-			self = "1"
+	for key, values := range gauges {
+		for l, value := range values {
+			ch <- mustNewConstMetric(&ctx, e.connectionMetricsG[key], prometheus.GaugeValue, value, e.labelValues(cluster, l)...)
 		}
-		gaugeVecWithLabelValues(&ctx, e.stateMetric, cluster, connD.labels["vhost"], connD.labels["node"], connD.labels["peer_host"], connD.labels["user"], connD.labels["state"], self).Add(1)
 	}
-
-	for _, gauge := range e.connectionMetricsG {
-		gauge.Collect(ch)
+	for l, value := range opened {
+		ch <- mustNewConstMetric(&ctx, e.connectionOpened, prometheus.GaugeValue, value, e.labelValues(cluster, l)...)
+	}
+	for l, histogram := range channels {
+		ch <- mustNewConstHistogram(&ctx, e.connectionChannels, histogram.count, histogram.sum, histogram.buckets, e.labelValues(cluster, l)...)
+	}
+	for l, value := range states {
+		ch <- mustNewConstMetric(&ctx, e.connectionState, prometheus.GaugeValue, value, append([]string{cluster, l.vhost, l.node, l.peerHost, l.user, l.state, l.self}, e.clientLabelValues(l)...)...)
 	}
-	e.stateMetric.Collect(ch)
 	return nil
 }
 
+//labelValues returns the values for the labels of the connection gauges
+func (e exporterConnections) labelValues(cluster string, l connectionLabelValues) []string {
+	return append([]string{cluster, l.vhost, l.node, l.peerHost, l.user, l.self}, e.clientLabelValues(l)...)
+}
+
+//clientLabelValues returns the values of the enabled client labels and the connection label of per_connection
+func (e exporterConnections) clientLabelValues(l connectionLabelValues) []string {
+	values := make([]string, 0, len(e.clientLabels)+1)
+	for _, i := range e.clientLabels {
+		values = append(values, l.client[i])
+	}
+	if e.perConnection {
+		values = append(values, l.connection)
+	}
+	return values
+}
+
+//aggregateConnection clears the labels which are not part of the aggregation level.
+//The vhost level keeps only the vhost, the node level only the node and self. The client labels are kept down to the user level.
+func aggregateConnection(aggregation string, labels connectionLabelValues) connectionLabelValues {
+	switch aggregation {
+	case "peer_host":
+		labels.connection = ""
+	case "user":
+		labels.connection, labels.peerHost = "", ""
+	case "vhost":
+		return connectionLabelValues{vhost: labels.vhost, state: labels.state}
+	case "node":
+		return connectionLabelValues{node: labels.node, self: labels.self, state: labels.state}
+	}
+	return labels
+}
+
+//observe adds the number of channels of a connection to the histogram. The buckets are cumulative.
+func (h *connectionChannelHistogram) observe(channels float64) {
+	h.count++
+	h.sum += channels
+	for _, bound := range connectionChannelBuckets {
+		if channels <= bound {
+			h.buckets[bound]++
+		}
+	}
+}
+
+//connectionClientLabel returns the index of label in connectionClientLabels or -1 if it is unknown
+func connectionClientLabel(label string) int {
+	for i, clientLabel := range connectionClientLabels {
+		if label == clientLabel {
+			return i
+		}
+	}
+	return -1
+}
+
+//columns returns the fields of a connection needed for the enabled metrics
+func (e exporterConnections) columns() []string {
+	columns := append([]string{}, e.labelKeys...)
+	for key := range e.connectionMetricsG {
+		columns = append(columns, key)
+	}
+	if e.connectionOpened != nil {
+		columns = append(columns, "connected_at")
+	}
+	if e.connectionChannels != nil {
+		columns = append(columns, "channels")
+	}
+	return columns
+}
+
 func (e exporterConnections) Describe(ch chan<- *prometheus.Desc) {
 	for _, nodeMetric := range e.connectionMetricsG {
-		nodeMetric.Describe(ch)
+		ch <- nodeMetric
 	}
-
+	if e.connectionOpened != nil {
+		ch <- e.connectionOpened
+	}
+	if e.connectionChannels != nil {
+		ch <- e.connectionChannels
+	}
+	ch <- e.connectionState
 }
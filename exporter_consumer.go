@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterExporter("consumer", newExporterConsumer)
+}
+
+var (
+	consumerLabels               = []string{"cluster", "vhost", "queue", "ack_required", "exclusive", "activity_status"}
+	consumerLabelsConnectionName = []string{"cluster", "vhost", "queue", "ack_required", "exclusive", "activity_status", "connection_name"}
+	consumerLabelKeys            = []string{"queue.vhost", "queue.name", "ack_required", "exclusive", "activity_status", "channel_details.connection_name"}
+
+	consumerGaugeVec = map[string]string{
+		"prefetch_count": "Sum of the prefetch count of the consumers (0 = unlimited).",
+	}
+)
+
+type exporterConsumer struct {
+	consumerCount    *prometheus.Desc
+	consumerMetricsG map[string]*prometheus.Desc
+	connectionName   bool
+}
+
+//consumerLabelValues are the label values the consumers of a queue are counted by
+type consumerLabelValues struct {
+	vhost, queue, ackRequired, exclusive, activityStatus, connectionName string
+}
+
+func newExporterConsumer() Exporter {
+	// the connection_name label is optional, so the descriptions depend on the configuration
+	labels := consumerLabels
+	if config.ConsumerConnectionName {
+		labels = consumerLabelsConnectionName
+	}
+
+	consumerGauges := make(map[string]*prometheus.Desc, len(consumerGaugeVec))
+	for key, help := range consumerGaugeVec {
+		consumerGauges[key] = newDesc("consumer_"+key, help, labels)
+	}
+
+	return exporterConsumer{
+		consumerCount:    newDesc("consumer_count", "Number of consumers of a queue.", labels),
+		consumerMetricsG: withoutExcludedMetrics(consumerGauges),
+		connectionName:   config.ConsumerConnectionName,
+	}
+}
+
+func (e exporterConsumer) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	config := configFromContext(ctx)
+	consumerData, err := getStatsInfo(ctx, config, "consumers", consumerLabelKeys)
+	if err != nil {
+		return err
+	}
+
+	cluster := ""
+	if n, ok := ctx.Value(clusterName).(string); ok {
+		cluster = n
+	}
+
+	// consumers with the same labels are counted and summed up
+	gauges := make(map[string]map[consumerLabelValues]float64, len(e.consumerMetricsG))
+	counts := make(map[consumerLabelValues]float64)
+	for _, consumer := range consumerData {
+		qname := consumer.labels["queue.name"]
+		vname := consumer.labels["queue.vhost"]
+
+		if vhostIncluded := config.IncludeVHost.MatchString(vname); !vhostIncluded {
+			continue
+		}
+		if skipVhost := config.SkipVHost.MatchString(vname); skipVhost {
+			continue
+		}
+		if queueIncluded := config.IncludeQueues.MatchString(qname); !queueIncluded {
+			continue
+		}
+		if queueSkipped := config.SkipQueues.MatchString(qname); queueSkipped {
+			continue
+		}
+
+		labels := consumerLabelValues{
+			vhost:          vname,
+			queue:          qname,
+			ackRequired:    consumer.labels["ack_required"],
+			exclusive:      consumer.labels["exclusive"],
+			activityStatus: consumer.labels["activity_status"],
+		}
+		if e.connectionName {
+			labels.connectionName = consumer.labels["channel_details.connection_name"]
+		}
+
+		counts[labels]++
+		for key := range e.consumerMetricsG {
+			if value, ok := consumer.metrics[key]; ok {
+				if gauges[key] == nil {
+					gauges[key] = make(map[consumerLabelValues]float64)
+				}
+				gauges[key][labels] += value
+			}
+		}
+	}
+
+	for l, value := range counts {
+		ch <- mustNewConstMetric(&ctx, e.consumerCount, prometheus.GaugeValue, value, e.labelValues(cluster, l)...)
+	}
+	for key, values := range gauges {
+		for l, value := range values {
+			ch <- mustNewConstMetric(&ctx, e.consumerMetricsG[key], prometheus.GaugeValue, value, e.labelValues(cluster, l)...)
+		}
+	}
+	return nil
+}
+
+//labelValues returns the values for the labels of the consumer metrics
+func (e exporterConsumer) labelValues(cluster string, l consumerLabelValues) []string {
+	values := []string{cluster, l.vhost, l.queue, l.ackRequired, l.exclusive, l.activityStatus}
+	if e.connectionName {
+		values = append(values, l.connectionName)
+	}
+	return values
+}
+
+func (e exporterConsumer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.consumerCount
+	for _, consumerMetric := range e.consumerMetricsG {
+		ch <- consumerMetric
+	}
+}
@@ -11,8 +11,9 @@ func init() {
 }
 
 var (
-	exchangeLabels    = []string{"cluster", "vhost", "exchange"}
-	exchangeLabelKeys = []string{"vhost", "name"}
+	exchangeLabels     = []string{"cluster", "vhost", "exchange"}
+	exchangeInfoLabels = []string{"cluster", "vhost", "exchange", "type", "durable", "internal", "auto_delete"}
+	exchangeLabelKeys  = []string{"vhost", "name", "type", "durable", "internal", "auto_delete"}
 
 	exchangeCounterVec = map[string]*prometheus.Desc{
 		"message_stats.publish":           newDesc("exchange_messages_published_total", "Count of messages published.", exchangeLabels),
@@ -27,6 +28,8 @@ var (
 		"message_stats.redeliver":         newDesc("exchange_messages_redelivered_total", "Count of subset of messages in deliver_get which had the redelivered flag set.", exchangeLabels),
 		"message_stats.return_unroutable": newDesc("exchange_messages_returned_total", "Count of messages returned to publisher as unroutable.", exchangeLabels),
 	}
+
+	exchangeInfoDesc = newDesc("exchange_info", "A metric with a constant '1' value for every exchange, labeled by its type and flags.", exchangeInfoLabels)
 )
 
 type exporterExchange struct {
@@ -34,46 +37,48 @@ type exporterExchange struct {
 }
 
 func newExporterExchange() Exporter {
-	exchangeCounterVecActual := exchangeCounterVec
-
-	if len(config.ExcludeMetrics) > 0 {
-		for _, metric := range config.ExcludeMetrics {
-			if exchangeCounterVecActual[metric] != nil {
-				delete(exchangeCounterVecActual, metric)
-			}
-		}
-	}
-
 	return exporterExchange{
-		exchangeMetrics: exchangeCounterVecActual,
+		exchangeMetrics: withoutExcludedMetrics(exchangeCounterVec),
 	}
 }
 
 func (e exporterExchange) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	exchangeData, err := getStatsInfo(config, "exchanges", exchangeLabelKeys)
-
-	if err != nil {
-		return err
-	}
+	config := configFromContext(ctx)
 	cluster := ""
 	if n, ok := ctx.Value(clusterName).(string); ok {
 		cluster = n
 	}
 
-	for key, countvec := range e.exchangeMetrics {
-		for _, exchange := range exchangeData {
-			if value, ok := exchange.metrics[key]; ok {
-				// log.WithFields(log.Fields{"vhost": exchange.vhost, "exchange": exchange.name, "key": key, "value": value}).Debug("Set exchange metric for key")
-				ch <- mustNewConstMetric(&ctx, countvec, prometheus.CounterValue, value, cluster, exchange.labels["vhost"], exchange.labels["name"])
-			}
+	return forEachPagedStatsInfo(ctx, config, "exchanges", exchangeLabelKeys, serverSideFilter(config.IncludeExchanges), e.columns(), func(exchange StatsInfo) {
+		vname, ename := exchange.labels["vhost"], exchange.labels["name"]
+		if !exchangeIncluded(config, vname, ename) {
+			return
 		}
-	}
+		for key, countvec := range e.exchangeMetrics {
+			// counters are exported with 0 if rabbitmq did not return a value yet
+			ch <- mustNewConstMetric(&ctx, countvec, prometheus.CounterValue, exchange.metrics[key], cluster, vname, ename)
+		}
+		ch <- mustNewConstMetric(&ctx, exchangeInfoDesc, prometheus.GaugeValue, 1, cluster, vname, ename, exchange.labels["type"], exchange.labels["durable"], exchange.labels["internal"], exchange.labels["auto_delete"])
+	})
+}
 
-	return nil
+//exchangeIncluded checks the exchange against the vhost and exchange filters
+func exchangeIncluded(config rabbitExporterConfig, vhost string, exchange string) bool {
+	return vhostIncluded(config, vhost) && config.IncludeExchanges.MatchString(exchange) && !config.SkipExchanges.MatchString(exchange)
+}
+
+//columns returns the fields of an exchange needed for the enabled metrics
+func (e exporterExchange) columns() []string {
+	columns := append([]string{}, exchangeLabelKeys...)
+	for key := range e.exchangeMetrics {
+		columns = append(columns, key)
+	}
+	return columns
 }
 
 func (e exporterExchange) Describe(ch chan<- *prometheus.Desc) {
 	for _, exchangeMetric := range e.exchangeMetrics {
 		ch <- exchangeMetric
 	}
+	ch <- exchangeInfoDesc
 }
@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -11,24 +17,53 @@ func init() {
 }
 
 var (
-	federationLabels     = []string{"cluster", "vhost", "node", "queue", "exchange", "self", "status"}
-	federationLabelsKeys = []string{"vhost", "status", "node", "queue", "exchange"}
+	federationLabels     = []string{"cluster", "vhost", "node", "queue", "exchange", "self", "upstream", "type", "upstream_host", "status"}
+	federationLinkLabels = []string{"cluster", "vhost", "node", "queue", "exchange", "self", "upstream", "type", "upstream_host"}
+	federationLabelsKeys = []string{"vhost", "status", "node", "queue", "exchange", "upstream", "type", "uri", "timestamp"}
+
+	federationStateDesc = newDesc("federation_state", "A metric with a value of constant '1' for each federation in a certain state", federationLabels)
+
+	federationGaugeVec = map[string]*prometheus.Desc{
+		"local_channel.messages_unacknowledged": newDesc("federation_link_messages_unacknowledged", "Number of messages delivered via the local channel of the federation link but not yet acknowledged.", federationLinkLabels),
+		"local_channel.messages_unconfirmed":    newDesc("federation_link_messages_unconfirmed", "Number of messages forwarded via the local channel of the federation link but not yet confirmed.", federationLinkLabels),
+		"local_channel.consumer_count":          newDesc("federation_link_consumers", "Number of consumers on the local channel of the federation link.", federationLinkLabels),
+	}
+
+	federationUpstreamLabels    = []string{"cluster", "vhost", "upstream", "upstream_host"}
+	federationUpstreamLabelKeys = []string{"vhost", "name", "value.uri"}
+	federationUpstreamSetLabels = []string{"cluster", "vhost", "upstream_set"}
+	federationPolicyLabelKeys   = []string{"vhost", "name", "pattern", "apply-to", "definition.federation-upstream-set", "definition.federation-upstream"}
+	federationSetMissingLabels  = []string{"cluster", "vhost", "policy", "upstream_set"}
+	federationObjectLabels      = []string{"cluster", "vhost", "type"}
+	federationObjectLabelKeys   = []string{"vhost", "name", "policy"}
+	federationLinkMissingLabels = []string{"cluster", "vhost", "queue", "exchange", "policy"}
+
+	federationUpstreamDesc    = newDesc("federation_upstream_info", "A metric with a constant '1' value for each federation upstream, labeled by the host of its uri.", federationUpstreamLabels)
+	federationUpstreamSetDesc = newDesc("federation_upstream_set_upstreams", "Number of upstreams of the federation upstream set.", federationUpstreamSetLabels)
+	federationSetMissingDesc  = newDesc("federation_upstream_set_missing", "A metric with a constant '1' value for each federation policy using an upstream set which does not exist.", federationSetMissingLabels)
+	federationExpectedDesc    = newDesc("federation_objects_expected", "Number of exchanges or queues with a policy applying federation.", federationObjectLabels)
+	federationLinkedDesc      = newDesc("federation_objects_linked", "Number of exchanges or queues with a policy applying federation and at least one running federation link.", federationObjectLabels)
+	federationLinkMissingDesc = newDesc("federation_link_missing", "Number of federation links expected by the policy of the exchange or queue which are not running.", federationLinkMissingLabels)
+
+	federationTimestampDesc = newDesc("federation_link_state_changed_timestamp_seconds", "Unix timestamp of the last state change of the federation link. The time of rabbitmq is interpreted in the time zone of the exporter.", federationLinkLabels)
 )
 
+//federationTimestampLayout is the format of the timestamp of a federation link
+const federationTimestampLayout = "2006-01-02 15:04:05"
+
 type exporterFederation struct {
-	stateMetric *prometheus.GaugeVec
+	federationMetricsG map[string]*prometheus.Desc
 }
 
 func newExporterFederation() Exporter {
 	return exporterFederation{
-		stateMetric: newGaugeVec("federation_state", "A metric with a value of constant '1' for each federation in a certain state", federationLabels),
+		federationMetricsG: withoutExcludedMetrics(federationGaugeVec),
 	}
 }
 
 func (e exporterFederation) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	e.stateMetric.Reset()
-
-	federationData, err := getStatsInfo(config, "federation-links", federationLabelsKeys)
+	config := configFromContext(ctx)
+	federationData, err := getStatsInfo(ctx, config, "federation-links", federationLabelsKeys)
 	if err != nil {
 		return err
 	}
@@ -42,18 +77,214 @@ func (e exporterFederation) Collect(ctx context.Context, ch chan<- prometheus.Me
 		selfNode = n
 	}
 
+	seen := make(map[[9]string]bool)
+	running := make(map[federationObject]float64)
 	for _, federation := range federationData {
+		if federation.labels["status"] == "running" {
+			running[federationObject{federation.labels["vhost"], federation.labels["type"], federation.labels["exchange"] + federation.labels["queue"]}]++
+		}
 		self := "0"
 		if federation.labels["node"] == selfNode {
 			self = "1"
 		}
-		gaugeVecWithLabelValues(&ctx, e.stateMetric, cluster, federation.labels["vhost"], federation.labels["node"], federation.labels["queue"], federation.labels["exchange"], self, federation.labels["status"]).Set(1)
+		labelValues := [9]string{cluster, federation.labels["vhost"], federation.labels["node"], federation.labels["queue"], federation.labels["exchange"], self, federation.labels["upstream"], federation.labels["type"], upstreamHost(federation.labels["uri"])}
+		if seen[labelValues] { // duplicate label combinations would break the registry
+			continue
+		}
+		seen[labelValues] = true
+
+		ch <- mustNewConstMetric(&ctx, federationStateDesc, prometheus.GaugeValue, 1, append(labelValues[:], federation.labels["status"])...)
+
+		for key, desc := range e.federationMetricsG {
+			if value, ok := federation.metrics[key]; ok {
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, labelValues[:]...)
+			}
+		}
+		if timestamp := federation.labels["timestamp"]; timestamp != "" {
+			changed, err := time.ParseInLocation(federationTimestampLayout, timestamp, time.Local)
+			if err != nil {
+				log.WithFields(log.Fields{"timestamp": timestamp, "error": err}).Warn("Invalid timestamp of federation link")
+				continue
+			}
+			ch <- mustNewConstMetric(&ctx, federationTimestampDesc, prometheus.GaugeValue, float64(changed.Unix()), labelValues[:]...)
+		}
+	}
+
+	if !config.FederationCoverage {
+		return nil
+	}
+	return e.collectCoverage(ctx, config, cluster, running, ch)
+}
+
+//federationObject identifies a federated exchange or queue. typ is exchange or queue.
+type federationObject struct {
+	vhost, typ, name string
+}
+
+//collectCoverage exports the configured upstreams and compares the exchanges and queues with a federation policy
+//with the running links. The exchanges and queues are only requested if there are federation policies applying to them.
+func (e exporterFederation) collectCoverage(ctx context.Context, config rabbitExporterConfig, cluster string, running map[federationObject]float64, ch chan<- prometheus.Metric) error {
+	upstreamData, err := getStatsInfo(ctx, config, "parameters/federation-upstream", federationUpstreamLabelKeys)
+	if err != nil {
+		return err
+	}
+	upstreamSetData, err := getStatsInfo(ctx, config, "parameters/federation-upstream-set", []string{"vhost", "name"})
+	if err != nil {
+		return err
+	}
+	policyData, err := getStatsInfo(ctx, config, "policies", federationPolicyLabelKeys)
+	if err != nil {
+		return err
+	}
+
+	upstreams := make(map[string]float64) // number of upstreams per vhost
+	for _, upstream := range upstreamData {
+		if !vhostIncluded(config, upstream.labels["vhost"]) {
+			continue
+		}
+		upstreams[upstream.labels["vhost"]]++
+		ch <- mustNewConstMetric(&ctx, federationUpstreamDesc, prometheus.GaugeValue, 1, cluster, upstream.labels["vhost"], upstream.labels["name"], upstreamHosts(upstream.labels["value.uri"]))
+	}
+	upstreamSets := make(map[[2]string]float64)
+	for _, set := range upstreamSetData {
+		if !vhostIncluded(config, set.labels["vhost"]) {
+			continue
+		}
+		upstreamSets[[2]string{set.labels["vhost"], set.labels["name"]}] = set.metrics["value_len"]
+		ch <- mustNewConstMetric(&ctx, federationUpstreamSetDesc, prometheus.GaugeValue, set.metrics["value_len"], cluster, set.labels["vhost"], set.labels["name"])
 	}
 
-	e.stateMetric.Collect(ch)
+	// number of links expected for the exchanges and queues of a policy
+	expectedLinks := make(map[[2]string]float64)
+	patterns := make(map[string]map[string]bool) // patterns of the federation policies per type
+	for _, policy := range policyData {
+		vname := policy.labels["vhost"]
+		if !vhostIncluded(config, vname) {
+			continue
+		}
+		key := [2]string{vname, policy.labels["name"]}
+		switch set, upstream := policy.labels["definition.federation-upstream-set"], policy.labels["definition.federation-upstream"]; {
+		case set == "all":
+			expectedLinks[key] = upstreams[vname]
+		case set != "":
+			size, ok := upstreamSets[[2]string{vname, set}]
+			if !ok { // no link can be running, the missing set is exported instead
+				ch <- mustNewConstMetric(&ctx, federationSetMissingDesc, prometheus.GaugeValue, 1, cluster, vname, policy.labels["name"], set)
+			}
+			expectedLinks[key] = size
+		case upstream != "":
+			expectedLinks[key] = 1
+		default:
+			continue
+		}
+		for _, typ := range policyTypes(policy.labels["apply-to"]) {
+			if patterns[typ] == nil {
+				patterns[typ] = make(map[string]bool)
+			}
+			patterns[typ][policy.labels["pattern"]] = true
+		}
+	}
+
+	expected := make(map[[2]string]float64)
+	linked := make(map[[2]string]float64)
+	for _, typ := range []string{"exchange", "queue"} {
+		if len(patterns[typ]) == 0 {
+			continue
+		}
+		err := forEachPagedStatsInfo(ctx, config, typ+"s", federationObjectLabelKeys, federationNameFilter(patterns[typ]), federationObjectLabelKeys, func(object StatsInfo) {
+			vname, policy := object.labels["vhost"], object.labels["policy"]
+			links, ok := expectedLinks[[2]string{vname, policy}]
+			if !ok {
+				return
+			}
+			key := [2]string{vname, typ}
+			expected[key]++
+			runningLinks := running[federationObject{vname, typ, object.labels["name"]}]
+			if runningLinks > 0 {
+				linked[key]++
+			}
+			missing := links - runningLinks
+			if missing < 0 {
+				missing = 0
+			}
+			exchange, queue := object.labels["name"], ""
+			if typ == "queue" {
+				exchange, queue = "", object.labels["name"]
+			}
+			ch <- mustNewConstMetric(&ctx, federationLinkMissingDesc, prometheus.GaugeValue, missing, cluster, vname, queue, exchange, policy)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for key, value := range expected {
+		ch <- mustNewConstMetric(&ctx, federationExpectedDesc, prometheus.GaugeValue, value, cluster, key[0], key[1])
+		ch <- mustNewConstMetric(&ctx, federationLinkedDesc, prometheus.GaugeValue, linked[key], cluster, key[0], key[1])
+	}
 	return nil
 }
 
+//policyTypes returns the types of the objects a policy applies to. apply-to is exchanges, queues, all or a queue type like quorum_queues.
+func policyTypes(applyTo string) []string {
+	switch applyTo {
+	case "exchanges":
+		return []string{"exchange"}
+	case "all", "":
+		return []string{"exchange", "queue"}
+	default:
+		return []string{"queue"}
+	}
+}
+
+//federationNameFilter combines the patterns of the policies to a server side filter of the names.
+//It is empty if one of the patterns matches all names or can not be used as filter.
+func federationNameFilter(patterns map[string]bool) string {
+	filters := make([]string, 0, len(patterns))
+	for pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return ""
+		}
+		filter := serverSideFilter(re)
+		if filter == "" {
+			return ""
+		}
+		filters = append(filters, "("+filter+")")
+	}
+	sort.Strings(filters)
+	return strings.Join(filters, "|")
+}
+
+//upstreamHosts returns the hosts of the comma-separated uris of an upstream
+func upstreamHosts(uris string) string {
+	var hosts []string
+	for _, uri := range strings.Split(uris, ",") {
+		if host := upstreamHost(uri); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
+//upstreamHost returns the host (and port) of the uri of an upstream. Credentials and parameters of the uri are not exported.
+func upstreamHost(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
 func (e exporterFederation) Describe(ch chan<- *prometheus.Desc) {
-	e.stateMetric.Describe(ch)
+	ch <- federationStateDesc
+	for _, desc := range e.federationMetricsG {
+		ch <- desc
+	}
+	ch <- federationTimestampDesc
+	ch <- federationUpstreamDesc
+	ch <- federationUpstreamSetDesc
+	ch <- federationSetMissingDesc
+	ch <- federationExpectedDesc
+	ch <- federationLinkedDesc
+	ch <- federationLinkMissingDesc
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterExporter("health", newExporterHealth)
+}
+
+var (
+	healthLabels       = []string{"cluster", "node", "check"}
+	healthReasonLabels = []string{"cluster", "node", "check", "reason"}
+
+	healthCheckStatusDesc = newDesc("health_check_status", "Result of the health check of the management api: 1 = ok, 0 = failed.", healthLabels)
+	healthCheckFailedDesc = newDesc("health_check_failure_info", "A metric with a constant '1' value labeled by the reason of a failed health check.", healthReasonLabels)
+
+	//healthChecks are the health checks of the management api and the versions of rabbitmq providing them
+	healthChecks = []healthCheck{
+		{name: "alarms", minVersion: "3.8.10"},
+		{name: "local-alarms", minVersion: "3.8.10"},
+		{name: "certificate-expiration", minVersion: "3.8.10", parameter: func(c rabbitExporterConfig) []string { return []string{c.HealthCertExpiration} }},
+		{name: "port-listener", minVersion: "3.8.10", parameter: func(c rabbitExporterConfig) []string { return c.HealthPorts }},
+		{name: "protocol-listener", minVersion: "3.8.10", parameter: func(c rabbitExporterConfig) []string { return c.HealthProtocols }},
+		{name: "virtual-hosts", minVersion: "3.8.10"},
+		{name: "node-is-mirror-sync-critical", minVersion: "3.8.10", maxVersion: "4.0.0"},
+		{name: "node-is-quorum-critical", minVersion: "3.8.10"},
+	}
+)
+
+type healthCheck struct {
+	name       string
+	minVersion string
+	maxVersion string                                // first version without the check
+	parameter  func(c rabbitExporterConfig) []string // the check is done once per parameter
+}
+
+type exporterHealth struct{}
+
+func newExporterHealth() Exporter {
+	return exporterHealth{}
+}
+
+func (e exporterHealth) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	config := configFromContext(ctx)
+	selfNode := ""
+	if n, ok := ctx.Value(nodeName).(string); ok {
+		selfNode = n
+	}
+	cluster := ""
+	if n, ok := ctx.Value(clusterName).(string); ok {
+		cluster = n
+	}
+	version := ""
+	if v, ok := ctx.Value(rabbitmqVersion).(string); ok {
+		version = v
+	}
+
+	for _, check := range healthChecks {
+		if !check.supported(version) {
+			log.WithFields(log.Fields{"check": check.name, "version": version}).Debug("Health check not supported by rabbitmq version")
+			continue
+		}
+		for _, name := range check.endpoints(config) {
+			ok, reason, err := healthCheckRequest(ctx, config, "health/checks/"+name)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			// a failed request only fails its own check, e.g. rabbitmq rejects the parameter of the check
+			if err != nil {
+				reason = err.Error()
+			}
+			if ok {
+				ch <- mustNewConstMetric(&ctx, healthCheckStatusDesc, prometheus.GaugeValue, 1, cluster, selfNode, name)
+				continue
+			}
+			log.WithFields(log.Fields{"check": name, "reason": reason}).Warn("Health check failed")
+			ch <- mustNewConstMetric(&ctx, healthCheckStatusDesc, prometheus.GaugeValue, 0, cluster, selfNode, name)
+			ch <- mustNewConstMetric(&ctx, healthCheckFailedDesc, prometheus.GaugeValue, 1, cluster, selfNode, name, reason)
+		}
+	}
+	return nil
+}
+
+//supported checks if the rabbitmq version provides the health check. Unknown versions are not checked.
+func (c healthCheck) supported(version string) bool {
+	if version == "" || !versionAtLeast(version, c.minVersion) {
+		return false
+	}
+	return c.maxVersion == "" || !versionAtLeast(version, c.maxVersion)
+}
+
+//endpoints returns the names of the health checks including the parameters, e.g. port-listener/5672
+func (c healthCheck) endpoints(config rabbitExporterConfig) []string {
+	if c.parameter == nil {
+		return []string{c.name}
+	}
+	var endpoints []string
+	for _, parameter := range c.parameter(config) {
+		if parameter = strings.TrimSpace(parameter); parameter != "" {
+			endpoints = append(endpoints, c.name+"/"+parameter)
+		}
+	}
+	return endpoints
+}
+
+//versionAtLeast compares the numeric parts of two versions like 3.8.10. Suffixes like -rc.1 or +1.g123 are ignored.
+func versionAtLeast(version string, min string) bool {
+	v, m := versionParts(version), versionParts(min)
+	for i := range m {
+		if i >= len(v) || v[i] < m[i] {
+			return false
+		}
+		if v[i] > m[i] {
+			return true
+		}
+	}
+	return true
+}
+
+func versionParts(version string) []int {
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+func (e exporterHealth) Describe(ch chan<- *prometheus.Desc) {
+	ch <- healthCheckStatusDesc
+	ch <- healthCheckFailedDesc
+}
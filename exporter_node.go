@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"net/url"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -12,42 +15,78 @@ func init() {
 
 var (
 	nodeLabels    = []string{"cluster", "node", "self"}
-	nodeLabelKeys = []string{"name"}
-
-	nodeGaugeVec = map[string]*prometheus.GaugeVec{
-		"uptime":          newGaugeVec("uptime", "Uptime in milliseconds", nodeLabels),
-		"running":         newGaugeVec("running", "number of running nodes", nodeLabels),
-		"mem_used":        newGaugeVec("node_mem_used", "Memory used in bytes", nodeLabels),
-		"mem_limit":       newGaugeVec("node_mem_limit", "Point at which the memory alarm will go off", nodeLabels),
-		"mem_alarm":       newGaugeVec("node_mem_alarm", "Whether the memory alarm has gone off", nodeLabels),
-		"disk_free":       newGaugeVec("node_disk_free", "Disk free space in bytes.", nodeLabels),
-		"disk_free_alarm": newGaugeVec("node_disk_free_alarm", "Whether the disk alarm has gone off.", nodeLabels),
-		"disk_free_limit": newGaugeVec("node_disk_free_limit", "Point at which the disk alarm will go off.", nodeLabels),
-		"fd_used":         newGaugeVec("fd_used", "Used File descriptors", nodeLabels),
-		"fd_total":        newGaugeVec("fd_available", "File descriptors available", nodeLabels),
-		"sockets_used":    newGaugeVec("sockets_used", "File descriptors used as sockets.", nodeLabels),
-		"sockets_total":   newGaugeVec("sockets_available", "File descriptors available for use as sockets", nodeLabels),
-		"partitions_len":  newGaugeVec("partitions", "Current Number of network partitions. 0 is ok. If the cluster is splitted the value is at least 2", nodeLabels),
+	nodeLabelKeys = []string{"name", "type", "os_pid", "enabled_plugins", "partitions"}
+
+	nodeGaugeVec = map[string]*prometheus.Desc{
+		"uptime":            newDesc("uptime", "Uptime in milliseconds", nodeLabels),
+		"running":           newDesc("running", "number of running nodes", nodeLabels),
+		"mem_used":          newDesc("node_mem_used", "Memory used in bytes", nodeLabels),
+		"mem_limit":         newDesc("node_mem_limit", "Point at which the memory alarm will go off", nodeLabels),
+		"mem_alarm":         newDesc("node_mem_alarm", "Whether the memory alarm has gone off", nodeLabels),
+		"disk_free":         newDesc("node_disk_free", "Disk free space in bytes.", nodeLabels),
+		"disk_free_alarm":   newDesc("node_disk_free_alarm", "Whether the disk alarm has gone off.", nodeLabels),
+		"disk_free_limit":   newDesc("node_disk_free_limit", "Point at which the disk alarm will go off.", nodeLabels),
+		"fd_used":           newDesc("fd_used", "Used File descriptors", nodeLabels),
+		"fd_total":          newDesc("fd_available", "File descriptors available", nodeLabels),
+		"sockets_used":      newDesc("sockets_used", "File descriptors used as sockets.", nodeLabels),
+		"sockets_total":     newDesc("sockets_available", "File descriptors available for use as sockets", nodeLabels),
+		"partitions_len":    newDesc("partitions", "Current Number of network partitions. 0 is ok. If the cluster is splitted the value is at least 2", nodeLabels),
+		"proc_used":         newDesc("node_proc_used", "Number of Erlang processes in use", nodeLabels),
+		"proc_total":        newDesc("node_proc_available", "Maximum number of Erlang processes", nodeLabels),
+		"run_queue":         newDesc("node_run_queue", "Number of Erlang processes waiting to run", nodeLabels),
+		"processors":        newDesc("node_processors", "Number of cores detected and usable by Erlang", nodeLabels),
+		"io_read_avg_time":  newDesc("node_io_read_avg_time", "Average wall time of a read operation in milliseconds", nodeLabels),
+		"io_write_avg_time": newDesc("node_io_write_avg_time", "Average wall time of a write operation in milliseconds", nodeLabels),
+		"io_sync_avg_time":  newDesc("node_io_sync_avg_time", "Average wall time of a fsync operation in milliseconds", nodeLabels),
+		"io_seek_avg_time":  newDesc("node_io_seek_avg_time", "Average wall time of a seek operation in milliseconds", nodeLabels),
 	}
+
+	nodeCounterVec = map[string]*prometheus.Desc{
+		"io_read_count":                     newDesc("node_io_read_total", "Count of read operations", nodeLabels),
+		"io_read_bytes":                     newDesc("node_io_read_bytes_total", "Count of bytes read", nodeLabels),
+		"io_write_count":                    newDesc("node_io_write_total", "Count of write operations", nodeLabels),
+		"io_write_bytes":                    newDesc("node_io_write_bytes_total", "Count of bytes written", nodeLabels),
+		"io_sync_count":                     newDesc("node_io_sync_total", "Count of fsync operations", nodeLabels),
+		"io_seek_count":                     newDesc("node_io_seek_total", "Count of seek operations", nodeLabels),
+		"io_reopen_count":                   newDesc("node_io_reopen_total", "Count of times files have been reopened by the file handle cache", nodeLabels),
+		"io_file_handle_open_attempt_count": newDesc("node_io_file_handle_open_attempt_total", "Count of file handle open attempts", nodeLabels),
+		"mnesia_ram_tx_count":               newDesc("node_mnesia_ram_tx_total", "Count of mnesia transactions which have been performed that did not require writes to disk", nodeLabels),
+		"mnesia_disk_tx_count":              newDesc("node_mnesia_disk_tx_total", "Count of mnesia transactions which have been performed that required writes to disk", nodeLabels),
+		"msg_store_read_count":              newDesc("node_msg_store_read_total", "Count of messages which have been read from the message store", nodeLabels),
+		"msg_store_write_count":             newDesc("node_msg_store_write_total", "Count of messages which have been written to the message store", nodeLabels),
+		"queue_index_journal_write_count":   newDesc("node_queue_index_journal_write_total", "Count of records written to the queue index journal", nodeLabels),
+		"queue_index_read_count":            newDesc("node_queue_index_read_total", "Count of records read from the queue index", nodeLabels),
+		"queue_index_write_count":           newDesc("node_queue_index_write_total", "Count of records written to the queue index", nodeLabels),
+		"gc_num":                            newDesc("node_gc_total", "Count of garbage collections", nodeLabels),
+		"gc_bytes_reclaimed":                newDesc("node_gc_bytes_reclaimed_total", "Count of bytes of memory reclaimed by garbage collection", nodeLabels),
+		"context_switches":                  newDesc("node_context_switches_total", "Count of Erlang scheduler context switches", nodeLabels),
+	}
+
+	nodeInfoDesc = newDesc("node_info", "A metric with a constant '1' value labeled by the type (disc, ram), OS pid and enabled plugins of the node.", append(nodeLabels, "type", "os_pid", "plugins"))
+
+	nodePartitionedFromDesc = newDesc("node_partitioned_from", "Whether the node is partitioned from the peer node: 1 = partitioned, 0 = connected.", append(nodeLabels, "peer"))
+	nodeExpectedMissingDesc = newDesc("node_expected_but_missing", "Whether a node of EXPECTED_NODES is missing in the cluster: 1 = missing, 0 = member of the cluster.", []string{"cluster", "node"})
+
+	//nodeClusterLinkCounterVec maps the stats of the cluster links to the metrics of the traffic to the peer nodes
+	nodeClusterLinkCounterVec = map[string]*prometheus.Desc{
+		"send_bytes": newDesc("node_cluster_link_send_bytes_total", "Count of bytes sent to the peer node via the inter-node communication link.", append(nodeLabels, "peer")),
+		"recv_bytes": newDesc("node_cluster_link_received_bytes_total", "Count of bytes received from the peer node via the inter-node communication link.", append(nodeLabels, "peer")),
+	}
+
+	nodeMemoryDesc = newDesc("node_memory_bytes", "Memory used by the node in bytes, broken down by category (connection_readers, queue_procs, binary, mgmt_db, mnesia, code, ...).", append(nodeLabels, "category"))
 )
 
 type exporterNode struct {
-	nodeMetricsGauge map[string]*prometheus.GaugeVec
+	nodeMetricsGauge       map[string]*prometheus.Desc
+	nodeMetricsCounter     map[string]*prometheus.Desc
+	nodeClusterLinkMetrics map[string]*prometheus.Desc
 }
 
 func newExporterNode() Exporter {
-	nodeGaugeVecActual := nodeGaugeVec
-
-	if len(config.ExcludeMetrics) > 0 {
-		for _, metric := range config.ExcludeMetrics {
-			if nodeGaugeVecActual[metric] != nil {
-				delete(nodeGaugeVecActual, metric)
-			}
-		}
-	}
-
 	return exporterNode{
-		nodeMetricsGauge: nodeGaugeVecActual,
+		nodeMetricsGauge:       withoutExcludedMetrics(nodeGaugeVec),
+		nodeMetricsCounter:     withoutExcludedMetrics(nodeCounterVec),
+		nodeClusterLinkMetrics: withoutExcludedMetrics(nodeClusterLinkCounterVec),
 	}
 }
 
@@ -61,36 +100,129 @@ func (e exporterNode) Collect(ctx context.Context, ch chan<- prometheus.Metric)
 		cluster = n
 	}
 
-	nodeData, err := getStatsInfo(config, "nodes", nodeLabelKeys)
+	config := configFromContext(ctx)
+	nodeData, err := getStatsInfo(ctx, config, "nodes", nodeLabelKeys)
 
 	if err != nil {
 		return err
 	}
 
-	for _, gauge := range e.nodeMetricsGauge {
-		gauge.Reset()
+	members := make(map[string]bool, len(nodeData))
+	for _, node := range nodeData {
+		members[node.labels["name"]] = true
 	}
 
-	for key, gauge := range e.nodeMetricsGauge {
-		for _, node := range nodeData {
+	for _, node := range nodeData {
+		self := "0"
+		if node.labels["name"] == selfNode {
+			self = "1"
+		}
+		for key, desc := range e.nodeMetricsGauge {
+			if value, ok := node.metrics[key]; ok {
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, cluster, node.labels["name"], self)
+			}
+		}
+		for key, desc := range e.nodeMetricsCounter {
 			if value, ok := node.metrics[key]; ok {
-				self := "0"
-				if node.labels["name"] == selfNode {
-					self = "1"
-				}
-				gaugeVecWithLabelValues(&ctx, gauge, cluster, node.labels["name"], self).Set(value)
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.CounterValue, value, cluster, node.labels["name"], self)
+			}
+		}
+		ch <- mustNewConstMetric(&ctx, nodeInfoDesc, prometheus.GaugeValue, 1, cluster, node.labels["name"], self, node.labels["type"], node.labels["os_pid"], node.labels["enabled_plugins"])
+
+		e.collectPartitions(&ctx, node, members, []string{cluster, node.labels["name"], self}, ch)
+		e.collectClusterLinks(&ctx, node, []string{cluster, node.labels["name"], self}, ch)
+
+		if config.NodeMemory {
+			if err := collectNodeMemory(ctx, config, node.labels["name"], []string{cluster, node.labels["name"], self}, ch); err != nil {
+				log.WithFields(log.Fields{"node": node.labels["name"], "error": err}).Warn("Memory of node not readable")
+			}
+		}
+	}
+
+	for _, expected := range config.ExpectedNodes {
+		if expected = strings.TrimSpace(expected); expected == "" {
+			continue
+		}
+		missing := 1.0
+		if members[expected] {
+			missing = 0
+		}
+		ch <- mustNewConstMetric(&ctx, nodeExpectedMissingDesc, prometheus.GaugeValue, missing, cluster, expected)
+	}
+
+	return nil
+}
+
+//collectPartitions exports the partition matrix of a node: 1 for every node in its partitions list, 0 for the other members of the cluster.
+func (e exporterNode) collectPartitions(ctx *context.Context, node StatsInfo, members map[string]bool, labelValues []string, ch chan<- prometheus.Metric) {
+	partitioned := make(map[string]bool)
+	for _, peer := range strings.Split(node.labels["partitions"], ",") {
+		if peer != "" {
+			partitioned[peer] = true
+		}
+	}
+	peers := make(map[string]bool, len(members)+len(partitioned))
+	for peer := range members {
+		peers[peer] = partitioned[peer]
+	}
+	for peer := range partitioned {
+		peers[peer] = true
+	}
+	delete(peers, node.labels["name"])
+
+	for peer, isPartitioned := range peers {
+		value := 0.0
+		if isPartitioned {
+			value = 1
+		}
+		ch <- mustNewConstMetric(ctx, nodePartitionedFromDesc, prometheus.GaugeValue, value, append(labelValues, peer)...)
+	}
+}
+
+//collectClusterLinks exports the traffic of the inter-node communication links. The metrics are keyed by cluster_links.<peer>.stats.<stat>.
+func (e exporterNode) collectClusterLinks(ctx *context.Context, node StatsInfo, labelValues []string, ch chan<- prometheus.Metric) {
+	for key, value := range node.metrics {
+		link := strings.TrimPrefix(key, "cluster_links.")
+		if link == key {
+			continue
+		}
+		for stat, desc := range e.nodeClusterLinkMetrics {
+			if strings.HasSuffix(link, ".stats."+stat) {
+				peer := strings.TrimSuffix(link, ".stats."+stat)
+				ch <- mustNewConstMetric(ctx, desc, prometheus.CounterValue, value, append(labelValues, peer)...)
 			}
 		}
 	}
+}
 
-	for _, gauge := range e.nodeMetricsGauge {
-		gauge.Collect(ch)
+//collectNodeMemory exports the memory breakdown of a node. The totals of the breakdown are not exported as category.
+func collectNodeMemory(ctx context.Context, config rabbitExporterConfig, node string, labelValues []string, ch chan<- prometheus.Metric) error {
+	memory, err := getMetricMap(ctx, config, "nodes/"+url.PathEscape(node)+"/memory")
+	if err != nil {
+		return err
+	}
+	for key, value := range memory {
+		category := strings.TrimPrefix(key, "memory.")
+		if category == key || strings.HasPrefix(category, "total.") {
+			continue
+		}
+		ch <- mustNewConstMetric(&ctx, nodeMemoryDesc, prometheus.GaugeValue, value, append(labelValues, category)...)
 	}
 	return nil
 }
 
 func (e exporterNode) Describe(ch chan<- *prometheus.Desc) {
 	for _, nodeMetric := range e.nodeMetricsGauge {
-		nodeMetric.Describe(ch)
+		ch <- nodeMetric
+	}
+	for _, nodeMetric := range e.nodeMetricsCounter {
+		ch <- nodeMetric
+	}
+	for _, nodeMetric := range e.nodeClusterLinkMetrics {
+		ch <- nodeMetric
 	}
+	ch <- nodeInfoDesc
+	ch <- nodePartitionedFromDesc
+	ch <- nodeExpectedMissingDesc
+	ch <- nodeMemoryDesc
 }
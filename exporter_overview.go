@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -14,26 +15,23 @@ func init() {
 var (
 	overviewLabels = []string{"cluster"}
 
-	overviewMetricDescription = map[string]*prometheus.GaugeVec{
-		"object_totals.channels":               newGaugeVec("channels", "Number of channels.", overviewLabels),
-		"object_totals.connections":            newGaugeVec("connections", "Number of connections.", overviewLabels),
-		"object_totals.consumers":              newGaugeVec("consumers", "Number of message consumers.", overviewLabels),
-		"object_totals.queues":                 newGaugeVec("queues", "Number of queues in use.", overviewLabels),
-		"object_totals.exchanges":              newGaugeVec("exchanges", "Number of exchanges in use.", overviewLabels),
-		"queue_totals.messages":                newGaugeVec("queue_messages_global", "Number ready and unacknowledged messages in cluster.", overviewLabels),
-		"queue_totals.messages_ready":          newGaugeVec("queue_messages_ready_global", "Number of messages ready to be delivered to clients.", overviewLabels),
-		"queue_totals.messages_unacknowledged": newGaugeVec("queue_messages_unacknowledged_global", "Number of messages delivered to clients but not yet acknowledged.", overviewLabels),
+	overviewMetricDescription = map[string]*prometheus.Desc{
+		"object_totals.channels":               newDesc("channels", "Number of channels.", overviewLabels),
+		"object_totals.connections":            newDesc("connections", "Number of connections.", overviewLabels),
+		"object_totals.consumers":              newDesc("consumers", "Number of message consumers.", overviewLabels),
+		"object_totals.queues":                 newDesc("queues", "Number of queues in use.", overviewLabels),
+		"object_totals.exchanges":              newDesc("exchanges", "Number of exchanges in use.", overviewLabels),
+		"queue_totals.messages":                newDesc("queue_messages_global", "Number ready and unacknowledged messages in cluster.", overviewLabels),
+		"queue_totals.messages_ready":          newDesc("queue_messages_ready_global", "Number of messages ready to be delivered to clients.", overviewLabels),
+		"queue_totals.messages_unacknowledged": newDesc("queue_messages_unacknowledged_global", "Number of messages delivered to clients but not yet acknowledged.", overviewLabels),
 	}
 
-	rabbitmqVersionMetric = newGaugeVec(
-		"rabbitmq_version_info",
-		"A metric with a constant '1' value labeled by rabbitmq version, erlang version, node, cluster.",
-		[]string{"rabbitmq", "erlang", "node", "cluster"},
-	)
+	rabbitmqVersionDesc = newDesc("rabbitmq_version_info", "A metric with a constant '1' value labeled by rabbitmq version, erlang version, node, cluster.", []string{"rabbitmq", "erlang", "node", "cluster"})
 )
 
 type exporterOverview struct {
-	overviewMetrics map[string]*prometheus.GaugeVec
+	overviewMetrics map[string]*prometheus.Desc
+	mutex           sync.RWMutex
 	nodeInfo        NodeInfo
 }
 
@@ -47,28 +45,21 @@ type NodeInfo struct {
 }
 
 func newExporterOverview() *exporterOverview {
-	overviewMetricDescriptionActual := overviewMetricDescription
-
-	if len(config.ExcludeMetrics) > 0 {
-		for _, metric := range config.ExcludeMetrics {
-			if overviewMetricDescriptionActual[metric] != nil {
-				delete(overviewMetricDescriptionActual, metric)
-			}
-		}
-	}
-
 	return &exporterOverview{
-		overviewMetrics: overviewMetricDescriptionActual,
+		overviewMetrics: withoutExcludedMetrics(overviewMetricDescription),
 		nodeInfo:        NodeInfo{},
 	}
 }
 
-func (e exporterOverview) NodeInfo() NodeInfo {
+//NodeInfo returns the node information of the last successful collect
+func (e *exporterOverview) NodeInfo() NodeInfo {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
 	return e.nodeInfo
 }
 
 func (e *exporterOverview) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	body, contentType, err := apiRequest(config, "overview")
+	body, contentType, err := apiRequest(ctx, configFromContext(ctx), "overview")
 	if err != nil {
 		return err
 	}
@@ -80,37 +71,38 @@ func (e *exporterOverview) Collect(ctx context.Context, ch chan<- prometheus.Met
 
 	rabbitMqOverviewData := reply.MakeMap()
 
-	e.nodeInfo.Node, _ = reply.GetString("node")
-	e.nodeInfo.ErlangVersion, _ = reply.GetString("erlang_version")
-	e.nodeInfo.RabbitmqVersion, _ = reply.GetString("rabbitmq_version")
-	e.nodeInfo.ClusterName, _ = reply.GetString("cluster_name")
-	e.nodeInfo.TotalQueues = (int)(rabbitMqOverviewData["object_totals.queues"])
+	var nodeInfo NodeInfo
+	nodeInfo.Node, _ = reply.GetString("node")
+	nodeInfo.ErlangVersion, _ = reply.GetString("erlang_version")
+	nodeInfo.RabbitmqVersion, _ = reply.GetString("rabbitmq_version")
+	nodeInfo.ClusterName, _ = reply.GetString("cluster_name")
+	nodeInfo.TotalQueues = (int)(rabbitMqOverviewData["object_totals.queues"])
+
+	e.mutex.Lock()
+	e.nodeInfo = nodeInfo
+	e.mutex.Unlock()
 
-	rabbitmqVersionMetric.Reset()
-	gaugeVecWithLabelValues(&ctx, rabbitmqVersionMetric, e.nodeInfo.RabbitmqVersion, e.nodeInfo.ErlangVersion, e.nodeInfo.Node, e.nodeInfo.ClusterName).Set(1)
+	if ch == nil {
+		return nil
+	}
+
+	ch <- mustNewConstMetric(&ctx, rabbitmqVersionDesc, prometheus.GaugeValue, 1, nodeInfo.RabbitmqVersion, nodeInfo.ErlangVersion, nodeInfo.Node, nodeInfo.ClusterName)
 
 	log.WithField("overviewData", rabbitMqOverviewData).Debug("Overview data")
-	for key, gauge := range e.overviewMetrics {
+	for key, desc := range e.overviewMetrics {
 		if value, ok := rabbitMqOverviewData[key]; ok {
 			log.WithFields(log.Fields{"key": key, "value": value}).Debug("Set overview metric for key")
-			gaugeVecWithLabelValues(&ctx, gauge, e.nodeInfo.ClusterName).Set(value)
-		}
-	}
-
-	if ch != nil {
-		rabbitmqVersionMetric.Collect(ch)
-		for _, gauge := range e.overviewMetrics {
-			gauge.Collect(ch)
+			ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, nodeInfo.ClusterName)
 		}
 	}
 	return nil
 }
 
-func (e exporterOverview) Describe(ch chan<- *prometheus.Desc) {
-	rabbitmqVersionMetric.Describe(ch)
+func (e *exporterOverview) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rabbitmqVersionDesc
 
-	for _, gauge := range e.overviewMetrics {
-		gauge.Describe(ch)
+	for _, desc := range e.overviewMetrics {
+		ch <- desc
 	}
 
 }
@@ -15,34 +15,41 @@ func init() {
 
 var (
 	queueLabels    = []string{"cluster", "vhost", "queue", "durable", "policy", "self"}
-	queueLabelKeys = []string{"vhost", "name", "durable", "policy", "state", "node", "idle_since"}
-
-	queueGaugeVec = map[string]*prometheus.GaugeVec{
-		"messages_ready":                        newGaugeVec("queue_messages_ready", "Number of messages ready to be delivered to clients.", queueLabels),
-		"messages_unacknowledged":               newGaugeVec("queue_messages_unacknowledged", "Number of messages delivered to clients but not yet acknowledged.", queueLabels),
-		"messages":                              newGaugeVec("queue_messages", "Sum of ready and unacknowledged messages (queue depth).", queueLabels),
-		"messages_ready_ram":                    newGaugeVec("queue_messages_ready_ram", "Number of messages from messages_ready which are resident in ram.", queueLabels),
-		"messages_unacknowledged_ram":           newGaugeVec("queue_messages_unacknowledged_ram", "Number of messages from messages_unacknowledged which are resident in ram.", queueLabels),
-		"messages_ram":                          newGaugeVec("queue_messages_ram", "Total number of messages which are resident in ram.", queueLabels),
-		"messages_persistent":                   newGaugeVec("queue_messages_persistent", "Total number of persistent messages in the queue (will always be 0 for transient queues).", queueLabels),
-		"message_bytes":                         newGaugeVec("queue_message_bytes", "Sum of the size of all message bodies in the queue. This does not include the message properties (including headers) or any overhead.", queueLabels),
-		"message_bytes_ready":                   newGaugeVec("queue_message_bytes_ready", "Like message_bytes but counting only those messages ready to be delivered to clients.", queueLabels),
-		"message_bytes_unacknowledged":          newGaugeVec("queue_message_bytes_unacknowledged", "Like message_bytes but counting only those messages delivered to clients but not yet acknowledged.", queueLabels),
-		"message_bytes_ram":                     newGaugeVec("queue_message_bytes_ram", "Like message_bytes but counting only those messages which are in RAM.", queueLabels),
-		"message_bytes_persistent":              newGaugeVec("queue_message_bytes_persistent", "Like message_bytes but counting only those messages which are persistent.", queueLabels),
-		"consumers":                             newGaugeVec("queue_consumers", "Number of consumers.", queueLabels),
-		"consumer_utilisation":                  newGaugeVec("queue_consumer_utilisation", "Fraction of the time (between 0.0 and 1.0) that the queue is able to immediately deliver messages to consumers. This can be less than 1.0 if consumers are limited by network congestion or prefetch count.", queueLabels),
-		"memory":                                newGaugeVec("queue_memory", "Bytes of memory consumed by the Erlang process associated with the queue, including stack, heap and internal structures.", queueLabels),
-		"head_message_timestamp":                newGaugeVec("queue_head_message_timestamp", "The timestamp property of the first message in the queue, if present. Timestamps of messages only appear when they are in the paged-in state.", queueLabels), //https://github.com/rabbitmq/rabbitmq-server/pull/54
-		"arguments.x-max-length-bytes":          newGaugeVec("queue_max_length_bytes", "Total body size for ready messages a queue can contain before it starts to drop them from its head.", queueLabels),
-		"arguments.x-max-length":                newGaugeVec("queue_max_length", "How many (ready) messages a queue can contain before it starts to drop them from its head.", queueLabels),
-		"garbage_collection.min_heap_size":      newGaugeVec("queue_gc_min_heap", "Minimum heap size in words", queueLabels),
-		"garbage_collection.min_bin_vheap_size": newGaugeVec("queue_gc_min_vheap", "Minimum binary virtual heap size in words", queueLabels),
-		"garbage_collection.fullsweep_after":    newGaugeVec("queue_gc_collections_before_fullsweep", "Maximum generational collections before fullsweep", queueLabels),
-		"slave_nodes_len":                       newGaugeVec("queue_slaves_nodes_len", "Number of slave nodes attached to the queue", queueLabels),
-		"synchronised_slave_nodes_len":          newGaugeVec("queue_synchronised_slave_nodes_len", "Number of slave nodes in sync to the queue", queueLabels),
+	queueLabelKeys = []string{"vhost", "name", "durable", "policy", "state", "node", "idle_since", "leader", "type"}
+
+	queueGaugeVec = map[string]*prometheus.Desc{
+		"messages_ready":                        newDesc("queue_messages_ready", "Number of messages ready to be delivered to clients.", queueLabels),
+		"messages_unacknowledged":               newDesc("queue_messages_unacknowledged", "Number of messages delivered to clients but not yet acknowledged.", queueLabels),
+		"messages":                              newDesc("queue_messages", "Sum of ready and unacknowledged messages (queue depth).", queueLabels),
+		"messages_ready_ram":                    newDesc("queue_messages_ready_ram", "Number of messages from messages_ready which are resident in ram.", queueLabels),
+		"messages_unacknowledged_ram":           newDesc("queue_messages_unacknowledged_ram", "Number of messages from messages_unacknowledged which are resident in ram.", queueLabels),
+		"messages_ram":                          newDesc("queue_messages_ram", "Total number of messages which are resident in ram.", queueLabels),
+		"messages_persistent":                   newDesc("queue_messages_persistent", "Total number of persistent messages in the queue (will always be 0 for transient queues).", queueLabels),
+		"message_bytes":                         newDesc("queue_message_bytes", "Sum of the size of all message bodies in the queue. This does not include the message properties (including headers) or any overhead.", queueLabels),
+		"message_bytes_ready":                   newDesc("queue_message_bytes_ready", "Like message_bytes but counting only those messages ready to be delivered to clients.", queueLabels),
+		"message_bytes_unacknowledged":          newDesc("queue_message_bytes_unacknowledged", "Like message_bytes but counting only those messages delivered to clients but not yet acknowledged.", queueLabels),
+		"message_bytes_ram":                     newDesc("queue_message_bytes_ram", "Like message_bytes but counting only those messages which are in RAM.", queueLabels),
+		"message_bytes_persistent":              newDesc("queue_message_bytes_persistent", "Like message_bytes but counting only those messages which are persistent.", queueLabels),
+		"consumers":                             newDesc("queue_consumers", "Number of consumers.", queueLabels),
+		"consumer_utilisation":                  newDesc("queue_consumer_utilisation", "Fraction of the time (between 0.0 and 1.0) that the queue is able to immediately deliver messages to consumers. This can be less than 1.0 if consumers are limited by network congestion or prefetch count.", queueLabels),
+		"memory":                                newDesc("queue_memory", "Bytes of memory consumed by the Erlang process associated with the queue, including stack, heap and internal structures.", queueLabels),
+		"head_message_timestamp":                newDesc("queue_head_message_timestamp", "The timestamp property of the first message in the queue, if present. Timestamps of messages only appear when they are in the paged-in state.", queueLabels), //https://github.com/rabbitmq/rabbitmq-server/pull/54
+		"arguments.x-max-length-bytes":          newDesc("queue_max_length_bytes", "Total body size for ready messages a queue can contain before it starts to drop them from its head.", queueLabels),
+		"arguments.x-max-length":                newDesc("queue_max_length", "How many (ready) messages a queue can contain before it starts to drop them from its head.", queueLabels),
+		"garbage_collection.min_heap_size":      newDesc("queue_gc_min_heap", "Minimum heap size in words", queueLabels),
+		"garbage_collection.min_bin_vheap_size": newDesc("queue_gc_min_vheap", "Minimum binary virtual heap size in words", queueLabels),
+		"garbage_collection.fullsweep_after":    newDesc("queue_gc_collections_before_fullsweep", "Maximum generational collections before fullsweep", queueLabels),
+		"slave_nodes_len":                       newDesc("queue_slaves_nodes_len", "Number of slave nodes attached to the queue", queueLabels),
+		"synchronised_slave_nodes_len":          newDesc("queue_synchronised_slave_nodes_len", "Number of slave nodes in sync to the queue", queueLabels),
+		"members_len":                           newDesc("queue_members", "Number of members (nodes with a replica) of a quorum queue", queueLabels),
+		"online_len":                            newDesc("queue_online_members", "Number of online members of a quorum queue. The queue is available as long as a majority of the members is online", queueLabels),
+		"arguments.x-quorum-initial-group-size": newDesc("queue_quorum_initial_group_size", "Number of members a quorum queue was declared with", queueLabels),
 	}
 
+	queueStateDesc     = newDesc("queue_state", "A metric with a value of constant '1' if the queue is in a certain state", append(queueLabels, "state"))
+	queueLeaderDesc    = newDesc("queue_leader_info", "A metric with a constant '1' value labeled by the leader node and the type of a replicated queue (quorum, stream).", append(queueLabels, "type", "leader"))
+	queueIdleSinceDesc = newDesc("queue_idle_since_seconds", "starttime where the queue switched to idle state; in seconds since epoch (1970).", queueLabels)
+
 	queueCounterVec = map[string]*prometheus.Desc{
 		"disk_reads":                   newDesc("queue_disk_reads_total", "Total number of times messages have been read from disk by this queue since it started.", queueLabels),
 		"disk_writes":                  newDesc("queue_disk_writes_total", "Total number of times messages have been written to disk by this queue since it started.", queueLabels),
@@ -61,42 +68,19 @@ var (
 )
 
 type exporterQueue struct {
-	queueMetricsGauge   map[string]*prometheus.GaugeVec
+	queueMetricsGauge   map[string]*prometheus.Desc
 	queueMetricsCounter map[string]*prometheus.Desc
-	stateMetric         *prometheus.GaugeVec
-	idleSinceMetric     *prometheus.GaugeVec
 }
 
 func newExporterQueue() Exporter {
-	queueGaugeVecActual := queueGaugeVec
-	queueCounterVecActual := queueCounterVec
-
-	if len(config.ExcludeMetrics) > 0 {
-		for _, metric := range config.ExcludeMetrics {
-			if queueGaugeVecActual[metric] != nil {
-				delete(queueGaugeVecActual, metric)
-			}
-			if queueCounterVecActual[metric] != nil {
-				delete(queueCounterVecActual, metric)
-			}
-		}
-	}
-
 	return exporterQueue{
-		queueMetricsGauge:   queueGaugeVecActual,
-		queueMetricsCounter: queueCounterVecActual,
-		stateMetric:         newGaugeVec("queue_state", "A metric with a value of constant '1' if the queue is in a certain state", append(queueLabels, "state")),
-		idleSinceMetric:     newGaugeVec("queue_idle_since_seconds", "starttime where the queue switched to idle state; in seconds since epoch (1970).", queueLabels),
+		queueMetricsGauge:   withoutExcludedMetrics(queueGaugeVec),
+		queueMetricsCounter: withoutExcludedMetrics(queueCounterVec),
 	}
 }
 
 func (e exporterQueue) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	for _, gaugevec := range e.queueMetricsGauge {
-		gaugevec.Reset()
-	}
-	e.stateMetric.Reset()
-	e.idleSinceMetric.Reset()
-
+	config := configFromContext(ctx)
 	if config.MaxQueues > 0 {
 		// Get overview info to check total queues
 		totalQueues, ok := ctx.Value(totalQueues).(int)
@@ -122,57 +106,43 @@ func (e exporterQueue) Collect(ctx context.Context, ch chan<- prometheus.Metric)
 		cluster = n
 	}
 
-	rabbitMqQueueData, err := getStatsInfo(config, "queues", queueLabelKeys)
-
-	if err != nil {
-		return err
-	}
-
-	for key, gaugevec := range e.queueMetricsGauge {
-		for _, queue := range rabbitMqQueueData {
-			qname := queue.labels["name"]
-			vname := queue.labels["vhost"]
-			if value, ok := queue.metrics[key]; ok {
-
-				if matchVhost := config.IncludeVHost.MatchString(vname); matchVhost {
-					if skipVhost := config.SkipVHost.MatchString(vname); !skipVhost {
-						if matchInclude := config.IncludeQueues.MatchString(qname); matchInclude {
-							if matchSkip := config.SkipQueues.MatchString(qname); !matchSkip {
-								self := "0"
-								if queue.labels["node"] == selfNode {
-									self = "1"
-								}
-								// log.WithFields(log.Fields{"vhost": queue.labels["vhost"], "queue": queue.labels["name"], "key": key, "value": value}).Info("Set queue metric for key")
-								gaugeVecWithLabelValues(&ctx, gaugevec, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self).Set(value)
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	for _, queue := range rabbitMqQueueData {
+	return forEachPagedStatsInfo(ctx, config, "queues", queueLabelKeys, serverSideFilter(config.IncludeQueues), e.columns(), func(queue StatsInfo) {
 		qname := queue.labels["name"]
 		vname := queue.labels["vhost"]
 
 		if vhostIncluded := config.IncludeVHost.MatchString(vname); !vhostIncluded {
-			continue
+			return
 		}
 		if skipVhost := config.SkipVHost.MatchString(vname); skipVhost {
-			continue
+			return
 		}
 		if queueIncluded := config.IncludeQueues.MatchString(qname); !queueIncluded {
-			continue
+			return
 		}
 		if queueSkipped := config.SkipQueues.MatchString(qname); queueSkipped {
-			continue
+			return
 		}
 
 		self := "0"
 		if queue.labels["node"] == selfNode {
 			self = "1"
 		}
+		labelValues := []string{cluster, vname, qname, queue.labels["durable"], queue.labels["policy"], self}
+
+		for key, desc := range e.queueMetricsGauge {
+			if value, ok := queue.metrics[key]; ok {
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, labelValues...)
+			}
+		}
+
+		for key, desc := range e.queueMetricsCounter {
+			// counters are exported with 0 if rabbitmq did not return a value yet
+			ch <- mustNewConstMetric(&ctx, desc, prometheus.CounterValue, queue.metrics[key], labelValues...)
+		}
+
+		if leader := queue.labels["leader"]; leader != "" {
+			ch <- mustNewConstMetric(&ctx, queueLeaderDesc, prometheus.GaugeValue, 1, append(labelValues, queue.labels["type"], leader)...)
+		}
 
 		idleSince, exists := queue.labels["idle_since"]
 		if exists && idleSince != "" {
@@ -182,56 +152,36 @@ func (e exporterQueue) Collect(ctx context.Context, ch chan<- prometheus.Metric)
 				if state == "running" { //replace running state with idle if idle_since time is provided. Other states (flow, etc.) are not replaced
 					state = "idle"
 				}
-				gaugeVecWithLabelValues(&ctx, e.idleSinceMetric, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self).Set(unixSeconds)
-				gaugeVecWithLabelValues(&ctx, e.stateMetric, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self, state).Set(1)
+				ch <- mustNewConstMetric(&ctx, queueIdleSinceDesc, prometheus.GaugeValue, unixSeconds, labelValues...)
+				ch <- mustNewConstMetric(&ctx, queueStateDesc, prometheus.GaugeValue, 1, append(labelValues, state)...)
 			} else {
 				log.WithError(err).WithField("idle_since", idleSince).Warn("error parsing idle since time")
 			}
 		} else {
-			gaugeVecWithLabelValues(&ctx, e.stateMetric, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self, queue.labels["state"]).Set(1)
+			ch <- mustNewConstMetric(&ctx, queueStateDesc, prometheus.GaugeValue, 1, append(labelValues, queue.labels["state"])...)
 		}
-	}
+	})
+}
 
-	for key, countvec := range e.queueMetricsCounter {
-		for _, queue := range rabbitMqQueueData {
-			qname := queue.labels["name"]
-			vname := queue.labels["vhost"]
-
-			if matchVhost := config.IncludeVHost.MatchString(vname); matchVhost {
-				if skipVhost := config.SkipVHost.MatchString(vname); !skipVhost {
-					if matchInclude := config.IncludeQueues.MatchString(qname); matchInclude {
-						if matchSkip := config.SkipQueues.MatchString(qname); !matchSkip {
-							self := "0"
-							if queue.labels["node"] == selfNode {
-								self = "1"
-							}
-							if value, ok := queue.metrics[key]; ok {
-								ch <- mustNewConstMetric(&ctx, countvec, prometheus.CounterValue, value, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self)
-							} else {
-								ch <- mustNewConstMetric(&ctx, countvec, prometheus.CounterValue, 0, cluster, queue.labels["vhost"], queue.labels["name"], queue.labels["durable"], queue.labels["policy"], self)
-							}
-						}
-					}
-				}
-			}
-		}
+//columns returns the fields of a queue needed for the enabled metrics
+func (e exporterQueue) columns() []string {
+	columns := append([]string{}, queueLabelKeys...)
+	for key := range e.queueMetricsGauge {
+		columns = append(columns, key)
 	}
-
-	for _, gaugevec := range e.queueMetricsGauge {
-		gaugevec.Collect(ch)
+	for key := range e.queueMetricsCounter {
+		columns = append(columns, key)
 	}
-	e.stateMetric.Collect(ch)
-	e.idleSinceMetric.Collect(ch)
-
-	return nil
+	return columns
 }
 
 func (e exporterQueue) Describe(ch chan<- *prometheus.Desc) {
 	for _, gaugevec := range e.queueMetricsGauge {
-		gaugevec.Describe(ch)
+		ch <- gaugevec
 	}
-	e.stateMetric.Describe(ch)
-	e.idleSinceMetric.Describe(ch)
+	ch <- queueStateDesc
+	ch <- queueLeaderDesc
+	ch <- queueIdleSinceDesc
 	for _, countervec := range e.queueMetricsCounter {
 		ch <- countervec
 	}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -12,28 +16,59 @@ func init() {
 
 var (
 	//shovelLabels are the labels for all shovel mertrics
-	shovelLabels = []string{"cluster", "vhost", "shovel", "type", "self", "state"}
+	shovelLabels = []string{"cluster", "vhost", "shovel", "type", "self", "state", "src_protocol", "dest_protocol", "reason"}
 	//shovelLabelKeys are the important keys to be extracted from json
-	shovelLabelKeys = []string{"vhost", "name", "type", "node", "state"}
+	shovelLabelKeys          = []string{"vhost", "name", "type", "node", "state", "src_protocol", "dest_protocol", "reason", "timestamp"}
+	shovelRestartLabels      = []string{"cluster", "vhost", "shovel", "type", "node"}
+	shovelMissingLabels      = []string{"cluster", "vhost", "shovel"}
+	shovelParameterLabelKeys = []string{"vhost", "name"}
+
+	shovelStateDesc   = newDesc("shovel_state", "A metric with a value of constant '1' for each shovel in a certain state. The label reason is the error class of terminated shovels.", shovelLabels)
+	shovelRestartDesc = newDesc("shovel_restarts_total", "Count of changes of the status timestamp of the shovel between scrapes (restarts and state changes).", shovelRestartLabels)
+	shovelMissingDesc = newDesc("shovel_missing", "Whether a dynamic shovel is defined but not running on any node: 1 = missing, 0 = running.", shovelMissingLabels)
+
+	//shovelRestartStates keeps the restart counters of every scraped rabbitmq. It outlives the exporters, as /probe creates an exporter per request.
+	shovelRestartStates = shovelRestarts{targets: make(map[string]map[shovelRestartKey]*shovelRestart)}
 )
 
-type exporterShovel struct {
-	stateMetric *prometheus.GaugeVec
+//shovelRestartRetention is the time the counter of a shovel is kept after it was last seen.
+//A shovel which is missing for some scrapes continues with its count.
+const shovelRestartRetention = time.Hour
+
+type exporterShovel struct{}
+
+//shovelRestarts keeps the last status timestamp of every shovel between scrapes
+type shovelRestarts struct {
+	sync.Mutex
+	targets map[string]map[shovelRestartKey]*shovelRestart // rabbitURL -> shovels
+}
+
+type shovelRestartKey struct {
+	vhost, shovel, typ, node string
+}
+
+type shovelRestart struct {
+	timestamp string
+	count     float64
+	lastSeen  time.Time
 }
 
 func newExporterShovel() Exporter {
-	return exporterShovel{
-		stateMetric: newGaugeVec("shovel_state", "A metric with a value of constant '1' for each shovel in a certain state", shovelLabels),
-	}
+	return exporterShovel{}
 }
 
 func (e exporterShovel) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
-	e.stateMetric.Reset()
-
-	shovelData, err := getStatsInfo(config, "shovels", shovelLabelKeys)
+	config := configFromContext(ctx)
+	shovelData, err := getStatsInfo(ctx, config, "shovels", shovelLabelKeys)
 	if err != nil {
 		return err
 	}
+	// the parameters require the tag policymaker, without them only the missing shovels are not exported
+	parameterData, err := getStatsInfo(ctx, config, "parameters/shovel", shovelParameterLabelKeys)
+	if err != nil {
+		log.WithField("error", err).Warn("Shovel parameters not readable, rabbitmq_shovel_missing is not exported")
+		parameterData = nil
+	}
 
 	cluster := ""
 	if n, ok := ctx.Value(clusterName).(string); ok {
@@ -44,18 +79,89 @@ func (e exporterShovel) Collect(ctx context.Context, ch chan<- prometheus.Metric
 		selfNode = n
 	}
 
+	seen := make(map[[9]string]bool)
+	running := make(map[[2]string]bool)
 	for _, shovel := range shovelData {
 		self := "0"
 		if shovel.labels["node"] == selfNode {
 			self = "1"
 		}
-		gaugeVecWithLabelValues(&ctx, e.stateMetric, cluster, shovel.labels["vhost"], shovel.labels["name"], shovel.labels["type"], self, shovel.labels["state"]).Set(1)
+		labelValues := [9]string{cluster, shovel.labels["vhost"], shovel.labels["name"], shovel.labels["type"], self, shovel.labels["state"], shovel.labels["src_protocol"], shovel.labels["dest_protocol"], shovelErrorClass(shovel.labels["reason"])}
+		if shovel.labels["state"] == "running" {
+			running[[2]string{shovel.labels["vhost"], shovel.labels["name"]}] = true
+		}
+		if seen[labelValues] { // static shovels can run with the same name on several nodes
+			continue
+		}
+		seen[labelValues] = true
+		ch <- mustNewConstMetric(&ctx, shovelStateDesc, prometheus.GaugeValue, 1, labelValues[:]...)
+	}
+
+	for key, count := range shovelRestartStates.update(config.RabbitURL, shovelData, time.Now()) {
+		ch <- mustNewConstMetric(&ctx, shovelRestartDesc, prometheus.CounterValue, count, cluster, key.vhost, key.shovel, key.typ, key.node)
+	}
+
+	for _, parameter := range parameterData {
+		missing := 1.0
+		if running[[2]string{parameter.labels["vhost"], parameter.labels["name"]}] {
+			missing = 0
+		}
+		ch <- mustNewConstMetric(&ctx, shovelMissingDesc, prometheus.GaugeValue, missing, cluster, parameter.labels["vhost"], parameter.labels["name"])
 	}
 
-	e.stateMetric.Collect(ch)
 	return nil
 }
 
+//update counts the changes of the status timestamps since the last scrape of rabbitURL and returns the counts of the current shovels.
+//Shovels which are not seen for shovelRestartRetention are forgotten.
+func (r *shovelRestarts) update(rabbitURL string, shovelData []StatsInfo, now time.Time) map[shovelRestartKey]float64 {
+	r.Lock()
+	defer r.Unlock()
+
+	shovels, ok := r.targets[rabbitURL]
+	if !ok {
+		shovels = make(map[shovelRestartKey]*shovelRestart)
+		r.targets[rabbitURL] = shovels
+	}
+	counts := make(map[shovelRestartKey]float64, len(shovelData))
+	for _, shovel := range shovelData {
+		key := shovelRestartKey{shovel.labels["vhost"], shovel.labels["name"], shovel.labels["type"], shovel.labels["node"]}
+		restart, ok := shovels[key]
+		if !ok {
+			restart = &shovelRestart{timestamp: shovel.labels["timestamp"]}
+			shovels[key] = restart
+		} else if restart.timestamp != shovel.labels["timestamp"] {
+			restart.timestamp = shovel.labels["timestamp"]
+			restart.count++
+		}
+		restart.lastSeen = now
+		counts[key] = restart.count
+	}
+
+	for url, shovels := range r.targets {
+		for key, restart := range shovels {
+			if now.Sub(restart.lastSeen) > shovelRestartRetention {
+				delete(shovels, key)
+			}
+		}
+		if len(shovels) == 0 {
+			delete(r.targets, url)
+		}
+	}
+	return counts
+}
+
+//shovelErrorClass reduces the reason of a terminated shovel (an erlang term) to its first atom, e.g. failed_to_connect_using_provided_uris
+func shovelErrorClass(reason string) string {
+	reason = strings.TrimLeft(strings.TrimSpace(reason), "{")
+	if i := strings.IndexAny(reason, ",{} \t\n"); i >= 0 {
+		reason = reason[:i]
+	}
+	return strings.Trim(reason, "'")
+}
+
 func (e exporterShovel) Describe(ch chan<- *prometheus.Desc) {
-	e.stateMetric.Describe(ch)
+	ch <- shovelStateDesc
+	ch <- shovelRestartDesc
+	ch <- shovelMissingDesc
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterExporter("stream", newExporterStream)
+}
+
+var (
+	streamLabels              = []string{"cluster", "vhost", "stream", "self"}
+	streamLabelKeys           = []string{"vhost", "name", "node", "type"}
+	streamPublisherLabels     = []string{"cluster", "vhost", "stream", "connection", "publisher_id", "reference"}
+	streamPublisherLabelKeys  = []string{"queue.vhost", "queue.name", "connection_details.name", "reference"}
+	streamConsumerLabels      = []string{"cluster", "vhost", "stream", "connection", "subscription_id"}
+	streamConsumerLabelKeys   = []string{"queue.vhost", "queue.name", "connection_details.name"}
+	streamConnectionLabels    = []string{"cluster", "vhost", "node", "user", "self"}
+	streamConnectionLabelKeys = []string{"vhost", "name", "node", "user"}
+
+	streamGaugeVec = map[string]*prometheus.Desc{
+		"segments":         newDesc("stream_segments", "Number of segment files of the stream.", streamLabels),
+		"committed_offset": newDesc("stream_committed_offset", "Offset of the last message committed to a majority of the members of the stream.", streamLabels),
+	}
+
+	streamPublisherCounterVec = map[string]*prometheus.Desc{
+		"published": newDesc("stream_publisher_published_total", "Count of messages published by the publisher.", streamPublisherLabels),
+		"confirmed": newDesc("stream_publisher_confirmed_total", "Count of messages confirmed to the publisher.", streamPublisherLabels),
+		"errored":   newDesc("stream_publisher_errored_total", "Count of messages of the publisher which failed to be stored.", streamPublisherLabels),
+	}
+
+	streamConsumerGaugeVec = map[string]*prometheus.Desc{
+		"offset":     newDesc("stream_consumer_offset", "Offset of the last message delivered to the consumer.", streamConsumerLabels),
+		"offset_lag": newDesc("stream_consumer_offset_lag", "Number of messages between the offset of the consumer and the committed offset of the stream.", streamConsumerLabels),
+		"credits":    newDesc("stream_consumer_credits", "Number of credits of the consumer.", streamConsumerLabels),
+	}
+
+	streamConsumerCounterVec = map[string]*prometheus.Desc{
+		"consumed": newDesc("stream_consumer_consumed_total", "Count of messages delivered to the consumer.", streamConsumerLabels),
+	}
+
+	streamConnectionsDesc = newDesc("stream_connections", "Number of stream protocol connections aggregated per label combination.", streamConnectionLabels)
+)
+
+type exporterStream struct {
+	streamMetricsG          map[string]*prometheus.Desc
+	streamPublisherMetricsC map[string]*prometheus.Desc
+	streamConsumerMetricsG  map[string]*prometheus.Desc
+	streamConsumerMetricsC  map[string]*prometheus.Desc
+}
+
+//streamConnectionLabelValues are the label values the stream connections are counted by
+type streamConnectionLabelValues struct {
+	vhost, node, user, self string
+}
+
+func newExporterStream() Exporter {
+	return exporterStream{
+		streamMetricsG:          withoutExcludedMetrics(streamGaugeVec),
+		streamPublisherMetricsC: withoutExcludedMetrics(streamPublisherCounterVec),
+		streamConsumerMetricsG:  withoutExcludedMetrics(streamConsumerGaugeVec),
+		streamConsumerMetricsC:  withoutExcludedMetrics(streamConsumerCounterVec),
+	}
+}
+
+func (e exporterStream) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	config := configFromContext(ctx)
+	selfNode := ""
+	if n, ok := ctx.Value(nodeName).(string); ok {
+		selfNode = n
+	}
+	cluster := ""
+	if n, ok := ctx.Value(clusterName).(string); ok {
+		cluster = n
+	}
+
+	if len(e.streamMetricsG) > 0 && !maxQueuesExceeded(ctx, config) {
+		// streams can not be filtered by type on the server, so only the columns of the stream metrics are requested
+		err := forEachPagedStatsInfo(ctx, config, "queues", streamLabelKeys, serverSideFilter(config.IncludeQueues), e.columns(), func(queue StatsInfo) {
+			if queue.labels["type"] != "stream" || !streamIncluded(config, queue.labels["vhost"], queue.labels["name"]) {
+				return
+			}
+			self := "0"
+			if queue.labels["node"] == selfNode {
+				self = "1"
+			}
+			for key, desc := range e.streamMetricsG {
+				if value, ok := queue.metrics[key]; ok {
+					ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, cluster, queue.labels["vhost"], queue.labels["name"], self)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(e.streamPublisherMetricsC) > 0 {
+		publisherData, err := getStatsInfo(ctx, config, "stream/publishers", streamPublisherLabelKeys)
+		if err != nil {
+			return err
+		}
+		for _, publisher := range publisherData {
+			vname, sname := publisher.labels["queue.vhost"], publisher.labels["queue.name"]
+			if !streamIncluded(config, vname, sname) {
+				continue
+			}
+			labelValues := []string{cluster, vname, sname, publisher.labels["connection_details.name"], formatID(publisher.metrics["publisher_id"]), publisher.labels["reference"]}
+			for key, desc := range e.streamPublisherMetricsC {
+				// counters are exported with 0 if rabbitmq did not return a value yet
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.CounterValue, publisher.metrics[key], labelValues...)
+			}
+		}
+	}
+
+	if len(e.streamConsumerMetricsG)+len(e.streamConsumerMetricsC) > 0 {
+		consumerData, err := getStatsInfo(ctx, config, "stream/consumers", streamConsumerLabelKeys)
+		if err != nil {
+			return err
+		}
+		for _, consumer := range consumerData {
+			vname, sname := consumer.labels["queue.vhost"], consumer.labels["queue.name"]
+			if !streamIncluded(config, vname, sname) {
+				continue
+			}
+			labelValues := []string{cluster, vname, sname, consumer.labels["connection_details.name"], formatID(consumer.metrics["subscription_id"])}
+			for key, desc := range e.streamConsumerMetricsG {
+				if value, ok := consumer.metrics[key]; ok {
+					ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, labelValues...)
+				}
+			}
+			for key, desc := range e.streamConsumerMetricsC {
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.CounterValue, consumer.metrics[key], labelValues...)
+			}
+		}
+	}
+
+	connectionData, err := getStatsInfo(ctx, config, "stream/connections", streamConnectionLabelKeys)
+	if err != nil {
+		return err
+	}
+	// connections with the same labels are counted
+	counts := make(map[streamConnectionLabelValues]float64)
+	for _, connection := range connectionData {
+		self := "0"
+		if connection.labels["node"] == selfNode {
+			self = "1"
+		}
+		counts[streamConnectionLabelValues{connection.labels["vhost"], connection.labels["node"], connection.labels["user"], self}]++
+	}
+	for l, value := range counts {
+		ch <- mustNewConstMetric(&ctx, streamConnectionsDesc, prometheus.GaugeValue, value, cluster, l.vhost, l.node, l.user, l.self)
+	}
+	return nil
+}
+
+//maxQueuesExceeded reports if the queues are skipped because of MAX_QUEUES, like the queue module does
+func maxQueuesExceeded(ctx context.Context, config rabbitExporterConfig) bool {
+	if config.MaxQueues <= 0 {
+		return false
+	}
+	totalQueues, ok := ctx.Value(totalQueues).(int)
+	return ok && totalQueues > config.MaxQueues
+}
+
+//streamIncluded checks the stream against the vhost and queue filters
+func streamIncluded(config rabbitExporterConfig, vhost string, stream string) bool {
+	return vhostIncluded(config, vhost) && config.IncludeQueues.MatchString(stream) && !config.SkipQueues.MatchString(stream)
+}
+
+//formatID formats the numeric id of a publisher or subscription as label value
+func formatID(id float64) string {
+	return strconv.FormatFloat(id, 'f', -1, 64)
+}
+
+//columns returns the fields of a queue needed for the stream metrics
+func (e exporterStream) columns() []string {
+	columns := append([]string{}, streamLabelKeys...)
+	for key := range e.streamMetricsG {
+		columns = append(columns, key)
+	}
+	return columns
+}
+
+func (e exporterStream) Describe(ch chan<- *prometheus.Desc) {
+	for _, descs := range []map[string]*prometheus.Desc{e.streamMetricsG, e.streamPublisherMetricsC, e.streamConsumerMetricsG, e.streamConsumerMetricsC} {
+		for _, desc := range descs {
+			ch <- desc
+		}
+	}
+	ch <- streamConnectionsDesc
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterExporter("vhost", newExporterVhost)
+}
+
+var (
+	vhostLabels            = []string{"cluster", "vhost"}
+	vhostLabelsStateMetric = []string{"cluster", "vhost", "node", "state"}
+	vhostLabelKeys         = []string{"name"}
+	vhostLimitLabelKeys    = []string{"vhost"}
+
+	vhostGaugeVec = map[string]*prometheus.Desc{
+		"messages":                newDesc("vhost_messages", "Sum of ready and unacknowledged messages of all queues of the vhost.", vhostLabels),
+		"messages_ready":          newDesc("vhost_messages_ready", "Number of messages ready to be delivered to clients of all queues of the vhost.", vhostLabels),
+		"messages_unacknowledged": newDesc("vhost_messages_unacknowledged", "Number of messages delivered to clients but not yet acknowledged of all queues of the vhost.", vhostLabels),
+	}
+
+	vhostCounterVec = map[string]*prometheus.Desc{
+		"message_stats.publish":           newDesc("vhost_messages_published_total", "Count of messages published.", vhostLabels),
+		"message_stats.confirm":           newDesc("vhost_messages_confirmed_total", "Count of messages confirmed.", vhostLabels),
+		"message_stats.deliver":           newDesc("vhost_messages_delivered_total", "Count of messages delivered in acknowledgement mode to consumers.", vhostLabels),
+		"message_stats.deliver_no_ack":    newDesc("vhost_messages_delivered_noack_total", "Count of messages delivered in no-acknowledgement mode to consumers.", vhostLabels),
+		"message_stats.get":               newDesc("vhost_messages_get_total", "Count of messages delivered in acknowledgement mode in response to basic.get.", vhostLabels),
+		"message_stats.get_no_ack":        newDesc("vhost_messages_get_noack_total", "Count of messages delivered in no-acknowledgement mode in response to basic.get.", vhostLabels),
+		"message_stats.ack":               newDesc("vhost_messages_ack_total", "Count of messages acknowledged.", vhostLabels),
+		"message_stats.redeliver":         newDesc("vhost_messages_redelivered_total", "Count of subset of messages in deliver_get which had the redelivered flag set.", vhostLabels),
+		"message_stats.return_unroutable": newDesc("vhost_messages_returned_total", "Count of messages returned to publisher as unroutable.", vhostLabels),
+		"recv_oct":                        newDesc("vhost_received_bytes_total", "Count of bytes received by the connections of the vhost.", vhostLabels),
+		"send_oct":                        newDesc("vhost_send_bytes_total", "Count of bytes sent by the connections of the vhost.", vhostLabels),
+	}
+
+	vhostStateDesc = newDesc("vhost_cluster_state", "A metric with a value of constant '1' if the vhost is in a certain state on a node (RabbitMQ 3.8 and newer).", vhostLabelsStateMetric)
+
+	//vhostLimits maps the limits of /api/vhost-limits to the endpoint listing the objects of a vhost and the metrics of the limit and the current usage
+	vhostLimits = map[string]struct {
+		endpoint    string
+		limit, used *prometheus.Desc
+	}{
+		"max-connections": {"vhosts/%s/connections", newDesc("vhost_max_connections", "Maximum number of connections of the vhost.", vhostLabels), newDesc("vhost_connections", "Number of connections of a vhost with max-connections limit.", vhostLabels)},
+		"max-queues":      {"queues/%s", newDesc("vhost_max_queues", "Maximum number of queues of the vhost.", vhostLabels), newDesc("vhost_queues", "Number of queues of a vhost with max-queues limit.", vhostLabels)},
+	}
+)
+
+type exporterVhost struct {
+	vhostMetricsGauge   map[string]*prometheus.Desc
+	vhostMetricsCounter map[string]*prometheus.Desc
+}
+
+func newExporterVhost() Exporter {
+	return exporterVhost{
+		vhostMetricsGauge:   withoutExcludedMetrics(vhostGaugeVec),
+		vhostMetricsCounter: withoutExcludedMetrics(vhostCounterVec),
+	}
+}
+
+func (e exporterVhost) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	config := configFromContext(ctx)
+	cluster := ""
+	if n, ok := ctx.Value(clusterName).(string); ok {
+		cluster = n
+	}
+
+	// the states of a vhost are keyed by node names, so the nodes are needed to read them
+	nodes, err := getStatsInfo(ctx, config, namesEndpoint(config, "nodes"), []string{"name"})
+	if err != nil {
+		return err
+	}
+	labelKeys := append([]string{}, vhostLabelKeys...)
+	for _, node := range nodes {
+		labelKeys = append(labelKeys, "cluster_state."+node.labels["name"])
+	}
+
+	vhostData, err := getStatsInfo(ctx, config, "vhosts", labelKeys)
+	if err != nil {
+		return err
+	}
+	for _, vhost := range vhostData {
+		vname := vhost.labels["name"]
+		if !vhostIncluded(config, vname) {
+			continue
+		}
+
+		for key, desc := range e.vhostMetricsGauge {
+			if value, ok := vhost.metrics[key]; ok {
+				ch <- mustNewConstMetric(&ctx, desc, prometheus.GaugeValue, value, cluster, vname)
+			}
+		}
+		for key, desc := range e.vhostMetricsCounter {
+			// counters are exported with 0 if rabbitmq did not return a value yet
+			ch <- mustNewConstMetric(&ctx, desc, prometheus.CounterValue, vhost.metrics[key], cluster, vname)
+		}
+		for _, node := range nodes {
+			if state := vhost.labels["cluster_state."+node.labels["name"]]; state != "" {
+				ch <- mustNewConstMetric(&ctx, vhostStateDesc, prometheus.GaugeValue, 1, cluster, vname, node.labels["name"], state)
+			}
+		}
+	}
+
+	return e.collectLimits(ctx, config, cluster, ch)
+}
+
+//collectLimits exports the limits of the vhosts. The current usage is only requested for the vhosts with the limit.
+//The number of objects of such a vhost is bounded by the limit, so the lists are not paged.
+func (e exporterVhost) collectLimits(ctx context.Context, config rabbitExporterConfig, cluster string, ch chan<- prometheus.Metric) error {
+	limitData, err := getStatsInfo(ctx, config, "vhost-limits", vhostLimitLabelKeys)
+	if err != nil {
+		return err
+	}
+
+	for limit, descs := range vhostLimits {
+		for _, vhost := range limitData {
+			vname := vhost.labels["vhost"]
+			value, ok := vhost.metrics["value."+limit]
+			if !ok || !vhostIncluded(config, vname) {
+				continue
+			}
+
+			used := 0.0
+			endpoint := namesEndpoint(config, fmt.Sprintf(descs.endpoint, url.PathEscape(vname)))
+			if err := forEachStatsInfo(ctx, config, endpoint, nil, func(StatsInfo) { used++ }); err != nil {
+				return err
+			}
+			ch <- mustNewConstMetric(&ctx, descs.limit, prometheus.GaugeValue, value, cluster, vname)
+			ch <- mustNewConstMetric(&ctx, descs.used, prometheus.GaugeValue, used, cluster, vname)
+		}
+	}
+	return nil
+}
+
+//namesEndpoint returns the endpoint requesting only the names of the objects if the columns capability is enabled
+func namesEndpoint(config rabbitExporterConfig, endpoint string) string {
+	if !isCapEnabled(config, rabbitCapColumns) {
+		return endpoint
+	}
+	return endpoint + "?" + url.Values{"columns": {"name"}}.Encode()
+}
+
+//vhostIncluded checks the vhost against INCLUDE_VHOST and SKIP_VHOST
+func vhostIncluded(config rabbitExporterConfig, vhost string) bool {
+	return config.IncludeVHost.MatchString(vhost) && !config.SkipVHost.MatchString(vhost)
+}
+
+func (e exporterVhost) Describe(ch chan<- *prometheus.Desc) {
+	for _, gaugevec := range e.vhostMetricsGauge {
+		ch <- gaugevec
+	}
+	for _, countervec := range e.vhostMetricsCounter {
+		ch <- countervec
+	}
+	ch <- vhostStateDesc
+	for _, descs := range vhostLimits {
+		ch <- descs.limit
+		ch <- descs.used
+	}
+}
@@ -3,130 +3,304 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type rabbitJSONReply struct {
-	body []byte
-	keys map[string]interface{}
+	body    []byte
+	metrics MetricMap
+	strings map[string]string
 }
 
 func makeJSONReply(body []byte) (RabbitReply, error) {
-	return &rabbitJSONReply{body, nil}, nil
+	return &rabbitJSONReply{body: body}, nil
 }
 
 //MakeStatsInfo creates a slice of StatsInfo from json input. Only keys with float values are mapped into `metrics`.
 func (rep *rabbitJSONReply) MakeStatsInfo(labels []string) []StatsInfo {
 	var statistics []StatsInfo
-	var jsonArr []map[string]interface{}
-	decoder := json.NewDecoder(bytes.NewBuffer(rep.body))
-	if decoder == nil {
-		log.Error("JSON decoder not iniatilized")
+	err := decodeStatsInfo(json.NewDecoder(bytes.NewReader(rep.body)), labels, func(statsinfo StatsInfo) {
+		statistics = append(statistics, statsinfo)
+	})
+	if err != nil {
+		log.WithField("error", err).Error("Error while decoding json")
 		return make([]StatsInfo, 0)
 	}
+	return statistics
+}
 
-	if err := decoder.Decode(&jsonArr); err != nil {
+//MakePage creates a slice of StatsInfo from the items of a paginated json reply
+func (rep *rabbitJSONReply) MakePage(labels []string) ([]StatsInfo, int) {
+	var statistics []StatsInfo
+	pageCount, err := decodePage(json.NewDecoder(bytes.NewReader(rep.body)), labels, func(statsinfo StatsInfo) {
+		statistics = append(statistics, statsinfo)
+	})
+	if err != nil {
 		log.WithField("error", err).Error("Error while decoding json")
-		return make([]StatsInfo, 0)
+		return make([]StatsInfo, 0), 0
+	}
+	return statistics, pageCount
+}
+
+//MakeMap creates a map from json input. Only keys with float values are mapped.
+func (rep *rabbitJSONReply) MakeMap() MetricMap {
+	if err := rep.decodeMap(); err != nil {
+		log.WithField("error", err).Error("Error while decoding json")
+		return make(MetricMap)
+	}
+	return rep.metrics
+}
+
+func (rep *rabbitJSONReply) GetString(key string) (string, bool) {
+	if err := rep.decodeMap(); err != nil {
+		return "", false
 	}
+	value, ok := rep.strings[key]
+	return value, ok
+}
 
-	for _, el := range jsonArr {
-		field := ""
-		if _, fieldName := el["name"]; fieldName {
-			field = "name"
+//decodeMap decodes a single json object. Metrics and top level strings are kept, so the body is decoded only once.
+func (rep *rabbitJSONReply) decodeMap() error {
+	if rep.metrics != nil {
+		return nil
+	}
+	metrics := make(MetricMap)
+	strings := make(map[string]string)
+	decoder := json.NewDecoder(bytes.NewReader(rep.body))
+	err := decodeObject(decoder, func(key string) error {
+		token, err := decodeValue(decoder, metrics, nil, key)
+		if s, ok := token.(string); ok {
+			strings[key] = s
 		}
-		if _, fieldID := el["id"]; fieldID {
-			field = "id"
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	rep.metrics = metrics
+	rep.strings = strings
+	return nil
+}
+
+//objectKeys are the keys identifying an object of a list. Objects without any of them are ignored.
+var objectKeys = map[string]bool{"name": true, "id": true, "consumer_tag": true, "vhost": true, "publisher_id": true, "subscription_id": true}
+
+//namedLists are the keys of lists of objects which are mapped by the names of the objects, e.g. cluster_links.<peer>.stats.send_bytes
+var namedLists = map[string]bool{"cluster_links": true}
+
+//decodeStatsInfo decodes a json array of objects and calls fn for every object with one of the objectKeys.
+//The objects are decoded one at a time, without building generic maps of the whole reply.
+func decodeStatsInfo(decoder *json.Decoder, labels []string, fn func(StatsInfo)) error {
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for decoder.More() {
+		statsinfo := StatsInfo{
+			labels:  make(map[string]string, len(labels)),
+			metrics: make(MetricMap),
 		}
-		if field != "" {
-			log.WithFields(log.Fields{"element": el, "vhost": el["vhost"], field: el[field]}).Debug("Iterate over array")
-			statsinfo := StatsInfo{}
-			statsinfo.labels = make(map[string]string)
+		for _, label := range labels {
+			statsinfo.labels[label] = ""
+		}
+		named := false
 
-			for _, label := range labels {
-				statsinfo.labels[label] = ""
-				// 从返回的结果中根据所需要的label的key获取需要的label的值
-				if tmp, ok := el[label]; ok {
-					if v, ok := tmp.(string); ok {
-						statsinfo.labels[label] = v
-					} else if v, ok := tmp.(bool); ok {
-						statsinfo.labels[label] = strconv.FormatBool(v)
-					}
-				}
+		err := decodeObject(decoder, func(key string) error {
+			if objectKeys[key] {
+				named = true
 			}
-
-			statsinfo.metrics = make(MetricMap)
-			addFields(&statsinfo.metrics, "", el)
-			statistics = append(statistics, statsinfo)
+			_, err := decodeValue(decoder, statsinfo.metrics, statsinfo.labels, key)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if named {
+			fn(statsinfo)
 		}
 	}
+	return expectDelim(decoder, ']')
+}
 
-	return statistics
+//decodePage decodes a paginated reply, calls fn for every object of its items and returns the number of pages
+func decodePage(decoder *json.Decoder, labels []string, fn func(StatsInfo)) (int, error) {
+	pageCount := 0
+	err := decodeObject(decoder, func(key string) error {
+		switch key {
+		case "items":
+			return decodeStatsInfo(decoder, labels, fn)
+		case "page_count":
+			token, err := decoder.Token()
+			if count, ok := token.(float64); ok {
+				pageCount = int(count)
+			}
+			return err
+		default:
+			return skipValue(decoder)
+		}
+	})
+	return pageCount, err
 }
 
-//MakeMap creates a map from json input. Only keys with float values are mapped.
-func (rep *rabbitJSONReply) MakeMap() MetricMap {
-	flMap := make(MetricMap)
-	var output map[string]interface{}
-	decoder := json.NewDecoder(bytes.NewBuffer(rep.body))
-	if decoder == nil {
-		log.Error("JSON decoder not iniatilized")
-		return flMap
+//decodeObject reads a json object and calls fn for every key. fn has to consume the value of the key.
+func decodeObject(decoder *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
 	}
-
-	if err := decoder.Decode(&output); err != nil {
-		log.WithField("error", err).Error("Error while decoding json")
-		return flMap
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return errors.New("object key is not a string")
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
 	}
+	return expectDelim(decoder, '}')
+}
 
-	addFields(&flMap, "", output)
+//decodeValue adds the value of key to toMap. Numbers and booleans are mapped directly, objects recursively
+//with '.'-separated keys and arrays by their length (key_len). Strings, booleans and lists of strings are
+//stored in labels if the (nested) key is one of the labels. Scalar values are returned.
+func decodeValue(decoder *json.Decoder, toMap MetricMap, labels map[string]string, key string) (json.Token, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	_, isLabel := labels[key]
+	switch value := token.(type) {
+	case string:
+		if isLabel {
+			// 从返回的结果中根据所需要的label的key获取需要的label的值
+			labels[key] = value
+		}
+	case float64:
+		toMap[key] = value
+	case bool:
+		if isLabel {
+			labels[key] = strconv.FormatBool(value)
+		}
+		if value {
+			toMap[key] = 1
+		} else {
+			toMap[key] = 0
+		}
+	case json.Delim:
+		if value == '[' && namedLists[key] {
+			return nil, decodeNamedList(decoder, toMap, key)
+		}
+		if value == '[' {
+			length := 0
+			var values []string
+			for decoder.More() {
+				if isLabel {
+					// lists of strings are stored as comma-separated label
+					token, err := decodeValue(decoder, MetricMap{}, nil, key)
+					if err != nil {
+						return nil, err
+					}
+					if s, ok := token.(string); ok {
+						values = append(values, s)
+					}
+				} else if err := skipValue(decoder); err != nil {
+					return nil, err
+				}
+				length++
+			}
+			if isLabel {
+				labels[key] = strings.Join(values, ",")
+			}
+			toMap[key+"_len"] = float64(length)
+			return nil, expectDelim(decoder, ']')
+		}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			nested, ok := token.(string)
+			if !ok {
+				return nil, errors.New("object key is not a string")
+			}
+			if _, err := decodeValue(decoder, toMap, labels, key+"."+nested); err != nil {
+				return nil, err
+			}
+		}
+		return nil, expectDelim(decoder, '}')
+	}
+	return token, nil
+}
 
-	return flMap
+//decodeNamedList adds the values of the objects of a list to toMap. The keys are prefixed with key and the name of the object.
+//The opening '[' has to be read already.
+func decodeNamedList(decoder *json.Decoder, toMap MetricMap, key string) error {
+	length := 0
+	for decoder.More() {
+		item := make(MetricMap)
+		labels := map[string]string{"name": ""}
+		err := decodeObject(decoder, func(nested string) error {
+			_, err := decodeValue(decoder, item, labels, nested)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for nested, value := range item {
+			toMap[key+"."+labels["name"]+"."+nested] = value
+		}
+		length++
+	}
+	toMap[key+"_len"] = float64(length)
+	return expectDelim(decoder, ']')
 }
 
-func addFields(toMap *MetricMap, basename string, source map[string]interface{}) {
-	prefix := ""
-	if basename != "" {
-		prefix = basename + "."
-	}
-	for k, v := range source {
-		switch value := v.(type) {
-		case float64:
-			(*toMap)[prefix+k] = value
-		case []interface{}:
-			(*toMap)[prefix+k+"_len"] = float64(len(value))
-		case map[string]interface{}:
-			addFields(toMap, prefix+k, value)
-		case bool:
-			if value {
-				(*toMap)[prefix+k] = 1
+//skipValue reads the next value including all nested values
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
 			} else {
-				(*toMap)[prefix+k] = 0
+				depth--
 			}
 		}
+		if depth == 0 {
+			return nil
+		}
 	}
 }
 
-func (rep *rabbitJSONReply) GetString(key string) (string, bool) {
-	if rep.keys == nil {
-		keys := make(map[string]interface{})
-		decoder := json.NewDecoder(bytes.NewBuffer(rep.body))
-		if decoder == nil {
-			log.Error("JSON decoder not iniatilized")
-			return "", false
-		}
-		err := decoder.Decode(&keys)
-		if err != nil {
-			return "", false
-		}
-		rep.keys = keys
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
-	val, ok := rep.keys[key]
-	if !ok {
-		return "", false
+	if err != nil {
+		return err
 	}
-	value, ok := val.(string)
-	return value, ok
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return errors.New("expected " + expected.String() + " but got " + tokenString(token))
+	}
+	return nil
+}
+
+func tokenString(token json.Token) string {
+	if delim, ok := token.(json.Delim); ok {
+		return delim.String()
+	}
+	b, _ := json.Marshal(token)
+	return string(b)
 }
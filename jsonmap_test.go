@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"testing"
 )
 
@@ -70,3 +74,105 @@ func TestArraySize(t *testing.T) {
 		t.Error("Unexpected partitions size", v)
 	}
 }
+
+func TestMakePage(t *testing.T) {
+	reply, _ := makeJSONReply([]byte(`{"filtered_count":3,"item_count":2,"items":[{"name":"q1", "FloatKey":14,"nes":{"ted":15}},{"name":"q2", "vhost":"foo", "FloatKey":24,"nes":{"ted":25}}],"page":1,"page_count":2,"page_size":2,"total_count":3}`))
+
+	qinfo, pageCount := reply.MakePage(queueLabelKeys)
+	if pageCount != 2 {
+		t.Errorf("unexpected page count: %v", pageCount)
+	}
+	if len(qinfo) != 2 {
+		t.Fatalf("unexpected number of items: %v", len(qinfo))
+	}
+	if qinfo[1].labels["vhost"] != "foo" {
+		t.Errorf("unexpected qinfo vhost: %v", qinfo[1].labels["vhost"])
+	}
+	checkMap(qinfo[0].metrics, t, 10)
+	checkMap(qinfo[1].metrics, t, 20)
+}
+
+func TestNestedLabels(t *testing.T) {
+	reply, _ := makeJSONReply([]byte(`[{"consumer_tag":"ctag1","ack_required":true,"prefetch_count":10,"queue":{"name":"q1","vhost":"foo"},"channel_details":{"connection_name":"app1","number":1}}]`))
+
+	cinfo := reply.MakeStatsInfo(consumerLabelKeys)
+	if len(cinfo) != 1 {
+		t.Fatalf("unexpected number of consumers: %v", len(cinfo))
+	}
+	expected := map[string]string{"queue.name": "q1", "queue.vhost": "foo", "ack_required": "true", "exclusive": "", "activity_status": "", "channel_details.connection_name": "app1"}
+	for key, value := range expected {
+		if cinfo[0].labels[key] != value {
+			t.Errorf("unexpected label %v: %v", key, cinfo[0].labels[key])
+		}
+	}
+	if v := cinfo[0].metrics["channel_details.number"]; v != 1 {
+		t.Errorf("unexpected nested metric: %v", v)
+	}
+}
+
+func TestNamedLists(t *testing.T) {
+	reply, _ := makeJSONReply([]byte(`[{"name":"rabbit@node1","partitions":["rabbit@node2","rabbit@node3"],"cluster_links":[{"name":"rabbit@node2.example.com","peer_port":25672,"stats":{"send_bytes":4096}}]}]`))
+
+	ninfo := reply.MakeStatsInfo(nodeLabelKeys)
+	if len(ninfo) != 1 {
+		t.Fatalf("unexpected number of nodes: %v", len(ninfo))
+	}
+	if p := ninfo[0].labels["partitions"]; p != "rabbit@node2,rabbit@node3" {
+		t.Errorf("unexpected partitions: %v", p)
+	}
+	expected := map[string]float64{"cluster_links_len": 1, "cluster_links.rabbit@node2.example.com.peer_port": 25672, "cluster_links.rabbit@node2.example.com.stats.send_bytes": 4096}
+	for key, value := range expected {
+		if v, ok := ninfo[0].metrics[key]; !ok || v != value {
+			t.Errorf("unexpected metric %v: %v", key, v)
+		}
+	}
+}
+
+//queuesPayload builds a reply of /api/queues with n queues by repeating the queues of the testdata
+func queuesPayload(b *testing.B, n int) []byte {
+	data, err := ioutil.ReadFile("testdata/queues-3.7.0.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var queues []json.RawMessage
+	if err := json.Unmarshal(data, &queues); err != nil {
+		b.Fatal(err)
+	}
+
+	var payload bytes.Buffer
+	payload.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			payload.WriteString(",")
+		}
+		queue := queues[i%len(queues)]
+		var q struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(queue, &q)
+		payload.Write(bytes.Replace(queue, []byte(`"name":"`+q.Name+`"`), []byte(fmt.Sprintf(`"name":"queue-%d"`, i)), 1))
+	}
+	payload.WriteString("]")
+	return payload.Bytes()
+}
+
+func benchmarkMakeStatsInfo(b *testing.B, queues int) {
+	payload := queuesPayload(b, queues)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply, _ := makeJSONReply(payload)
+		if stats := reply.MakeStatsInfo(queueLabelKeys); len(stats) != queues {
+			b.Fatalf("expected %v queues, got %v", queues, len(stats))
+		}
+	}
+}
+
+func BenchmarkMakeStatsInfo10k(b *testing.B) {
+	benchmarkMakeStatsInfo(b, 10000)
+}
+
+func BenchmarkMakeStatsInfo100k(b *testing.B) {
+	benchmarkMakeStatsInfo(b, 100000)
+}
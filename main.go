@@ -6,6 +6,7 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +19,8 @@ import (
 const (
 	defaultLogLevel = log.InfoLevel
 	serviceName     = "RabbitMQ_exporter"
+	//scrapeTimeoutOffset is subtracted from the prometheus scrape timeout to have time left for sending the response
+	scrapeTimeoutOffset = 500 * time.Millisecond
 )
 
 func initLogger() {
@@ -50,7 +53,10 @@ func main() {
 	initLogger()
 	initClient()
 	exporter := newExporter()
-	prometheus.MustRegister(exporter)
+	scrapeCtx, stopScraping := context.WithCancel(context.Background())
+	if config.ScrapeInterval > 0 {
+		exporter.startBackgroundScrape(scrapeCtx, time.Duration(config.ScrapeInterval)*time.Second)
+	}
 
 	log.WithFields(log.Fields{
 		"VERSION":    Version,
@@ -61,37 +67,68 @@ func main() {
 	}).Info("Starting RabbitMQ exporter")
 
 	log.WithFields(log.Fields{
-		"PUBLISH_ADDR":        config.PublishAddr,
-		"PUBLISH_PORT":        config.PublishPort,
-		"RABBIT_URL":          config.RabbitURL,
-		"RABBIT_USER":         config.RabbitUsername,
-		"OUTPUT_FORMAT":       config.OutputFormat,
-		"RABBIT_CAPABILITIES": formatCapabilities(config.RabbitCapabilities),
-		"RABBIT_EXPORTERS":    config.EnabledExporters,
-		"CAFILE":              config.CAFile,
-		"CERTFILE":            config.CertFile,
-		"KEYFILE":             config.KeyFile,
-		"SKIPVERIFY":          config.InsecureSkipVerify,
-		"EXCLUDE_METRICS":     config.ExcludeMetrics,
-		"SKIP_QUEUES":         config.SkipQueues.String(),
-		"INCLUDE_QUEUES":      config.IncludeQueues,
-		"SKIP_VHOST":          config.SkipVHost.String(),
-		"INCLUDE_VHOST":       config.IncludeVHost,
-		"RABBIT_TIMEOUT":      config.Timeout,
-		"MAX_QUEUES":          config.MaxQueues,
-		"SubSystemName":       config.SubSystemName,
-		"SubsystemID":         config.SubSystemID,
+		"PUBLISH_ADDR":              config.PublishAddr,
+		"PUBLISH_PORT":              config.PublishPort,
+		"RABBIT_URL":                config.RabbitURL,
+		"RABBIT_USER":               config.RabbitUsername,
+		"OUTPUT_FORMAT":             config.OutputFormat,
+		"RABBIT_CAPABILITIES":       formatCapabilities(config.RabbitCapabilities),
+		"RABBIT_EXPORTERS":          config.EnabledExporters,
+		"CAFILE":                    config.CAFile,
+		"CERTFILE":                  config.CertFile,
+		"KEYFILE":                   config.KeyFile,
+		"SKIPVERIFY":                config.InsecureSkipVerify,
+		"EXCLUDE_METRICS":           config.ExcludeMetrics,
+		"SKIP_QUEUES":               config.SkipQueues.String(),
+		"INCLUDE_QUEUES":            config.IncludeQueues,
+		"SKIP_VHOST":                config.SkipVHost.String(),
+		"INCLUDE_VHOST":             config.IncludeVHost,
+		"SKIP_EXCHANGES":            config.SkipExchanges.String(),
+		"INCLUDE_EXCHANGES":         config.IncludeExchanges,
+		"RABBIT_TIMEOUT":            config.Timeout,
+		"MAX_QUEUES":                config.MaxQueues,
+		"MODULE_CONCURRENCY":        config.ModuleConcurrency,
+		"SCRAPE_INTERVAL":           config.ScrapeInterval,
+		"MODULE_TIMEOUTS":           config.ModuleTimeouts,
+		"RABBIT_RETRIES":            config.APIRetries,
+		"RABBIT_RETRY_BACKOFF":      config.APIRetryBackoff,
+		"CIRCUIT_BREAKER_THRESHOLD": config.CircuitBreakerThreshold,
+		"CIRCUIT_BREAKER_COOLDOWN":  config.CircuitBreakerCooldown,
+		"STALE_MAX_AGE":             config.StaleMaxAge,
+		"STALE_FILE":                config.StaleFile,
+		"PAGE_SIZE":                 config.PageSize,
+		"CHANNEL_AGGREGATION":       config.ChannelAggregation,
+		"CONSUMER_CONNECTION_NAME":  config.ConsumerConnectionName,
+		"CONNECTION_CLIENT_LABELS":  config.ConnectionClientLabels,
+		"CONNECTION_AGGREGATION":    config.ConnectionAggregation,
+		"HEALTH_CERT_EXPIRATION":    config.HealthCertExpiration,
+		"HEALTH_PORTS":              config.HealthPorts,
+		"HEALTH_PROTOCOLS":          config.HealthProtocols,
+		"NODE_MEMORY":               config.NodeMemory,
+		"EXPECTED_NODES":            config.ExpectedNodes,
+		"FEDERATION_COVERAGE":       config.FederationCoverage,
+		"PROBE_TARGETS":             config.ProbeTargets,
+		"SubSystemName":             config.SubSystemName,
+		"SubsystemID":               config.SubSystemID,
 		//		"RABBIT_PASSWORD": config.RABBIT_PASSWORD,
 	}).Info("Active Configuration")
 
 	handler := http.NewServeMux()
-	handler.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}))
+	handler.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporter.withContext(ctx))
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	handler.HandleFunc("/probe", probeHandler)
 	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>RabbitMQ Exporter</title></head>
              <body>
              <h1>RabbitMQ Exporter</h1>
              <p><a href='/metrics'>Metrics</a></p>
+             <p><a href='/probe?target=http://127.0.0.1:15672'>Probe</a></p>
              </body>
              </html>`))
 	})
@@ -113,6 +150,7 @@ func main() {
 
 	<-runService()
 	log.Info("Shutting down")
+	stopScraping()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	if err := server.Shutdown(ctx); err != nil {
@@ -121,6 +159,20 @@ func main() {
 	cancel()
 }
 
+//scrapeContext creates the context for scraping rabbitmq on behalf of request r.
+//The timeout announced by prometheus is used as deadline, so slow modules are cancelled before prometheus gives up.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		seconds, err := strconv.ParseFloat(header, 64)
+		if err != nil {
+			log.WithError(err).WithField("header", header).Warn("Invalid scrape timeout")
+		} else if timeout := time.Duration(seconds*float64(time.Second)) - scrapeTimeoutOffset; timeout > 0 {
+			return context.WithTimeout(r.Context(), timeout)
+		}
+	}
+	return context.WithCancel(r.Context())
+}
+
 func getLogLevel() log.Level {
 	lvl := strings.ToLower(os.Getenv("LOG_LEVEL"))
 	level, err := log.ParseLevel(lvl)
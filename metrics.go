@@ -54,6 +54,18 @@ func newDesc(metricName string, docString string, labels []string) *prometheus.D
 		nil)
 }
 
+//withoutExcludedMetrics returns a copy of descs without the metrics of EXCLUDE_METRICS
+func withoutExcludedMetrics(descs map[string]*prometheus.Desc) map[string]*prometheus.Desc {
+	actual := make(map[string]*prometheus.Desc, len(descs))
+	for key, desc := range descs {
+		actual[key] = desc
+	}
+	for _, metric := range config.ExcludeMetrics {
+		delete(actual, metric)
+	}
+	return actual
+}
+
 
 func counterVecWithLabelValues(ctx *context.Context,v *prometheus.CounterVec, lvs ...string) prometheus.Counter {
 	subsystemID := ""
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var probeTargetRegex = regexp.MustCompile("^https?://[a-zA-Z.0-9]+")
+
+//probeHandler scrapes the rabbitmq given by the 'target' parameter with the modules listed in 'module'.
+//Every request creates its own exporter and registry, so one exporter process can serve many clusters.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	target = normalizeProbeTarget(target)
+	if !probeTargetRegex.MatchString(strings.ToLower(target)) {
+		http.Error(w, fmt.Sprintf("target %q must start with http:// or https://", target), http.StatusBadRequest)
+		return
+	}
+	if !probeTargetAllowed(target) {
+		http.Error(w, fmt.Sprintf("target %q is not allowed. Add it to PROBE_TARGETS", target), http.StatusForbidden)
+		return
+	}
+
+	targetConfig := config
+	targetConfig.RabbitURL = target
+
+	if modules := r.URL.Query().Get("module"); modules != "" {
+		targetConfig.EnabledExporters = nil
+		for _, module := range strings.Split(modules, ",") {
+			module = strings.TrimSpace(module)
+			if module == "overview" { // overview is always scraped
+				continue
+			}
+			if _, ok := exporterFactories[module]; !ok {
+				http.Error(w, fmt.Sprintf("unknown module %q", module), http.StatusBadRequest)
+				return
+			}
+			targetConfig.EnabledExporters = append(targetConfig.EnabledExporters, module)
+		}
+	}
+
+	log.WithFields(log.Fields{"target": targetConfig.RabbitURL, "modules": targetConfig.EnabledExporters}).Debug("Probing target")
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTargetExporter(targetConfig).withContext(ctx))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+//probeTargetAllowed checks if target is RABBIT_URL or listed in PROBE_TARGETS.
+//The configured credentials are sent to the target, so arbitrary urls are rejected.
+func probeTargetAllowed(target string) bool {
+	if target == normalizeProbeTarget(config.RabbitURL) {
+		return true
+	}
+	for _, allowed := range config.ProbeTargets {
+		if target == normalizeProbeTarget(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+//normalizeProbeTarget adds the default scheme http:// and removes a trailing slash
+func normalizeProbeTarget(target string) string {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	return strings.TrimSuffix(target, "/")
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,6 +25,8 @@ import (
 
 var client = &http.Client{Timeout: 15 * time.Second} //default client for test. Client is initialized in initClient()
 
+const maxRetryBackoff = 10 * time.Second
+
 func initClient() {
 	var roots *x509.CertPool
 
@@ -60,69 +73,338 @@ func initClient() {
 
 }
 
-func apiRequest(config rabbitExporterConfig, endpoint string) ([]byte, string, error) {
+//apiRequest requests the endpoint and returns the whole body of the reply
+func apiRequest(ctx context.Context, config rabbitExporterConfig, endpoint string) ([]byte, string, error) {
+	body, content, err := openAPIRequest(ctx, config, endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	log.WithFields(log.Fields{"body": string(data), "endpoint": endpoint}).Debug("Metrics loaded")
+	return data, content, nil
+}
+
+//openAPIRequest requests the endpoint and returns the body of the reply, which has to be closed by the caller.
+//Failed requests are retried. Errors while reading the body are not retried.
+func openAPIRequest(ctx context.Context, config rabbitExporterConfig, endpoint string) (io.ReadCloser, string, error) {
+	breaker := getCircuitBreaker(config.RabbitURL, endpoint)
+	breakerEnabled := config.CircuitBreakerThreshold > 0
+	if breakerEnabled && !breaker.allow(time.Duration(config.CircuitBreakerCooldown)*time.Second) {
+		log.WithFields(log.Fields{"host": config.RabbitURL, "endpoint": endpoint}).Debug("Circuit breaker open, skipping request")
+		return nil, "", errors.New("Circuit breaker open for endpoint " + endpoint)
+	}
+
+	var body io.ReadCloser
+	var content string
+	var retryable bool
+	var err error
+retry:
+	for attempt := 0; ; attempt++ {
+		body, content, retryable, err = doAPIRequest(ctx, config, endpoint)
+		if err == nil || !retryable || attempt >= config.APIRetries {
+			break
+		}
+		backoff := retryBackoff(config, attempt)
+		log.WithFields(log.Fields{"endpoint": endpoint, "attempt": attempt + 1, "backoff": backoff}).Debug("Retrying request")
+		select {
+		case <-ctx.Done():
+			body, content, err = nil, "", ctx.Err()
+			break retry
+		case <-time.After(backoff):
+		}
+	}
+
+	if breakerEnabled {
+		switch {
+		case err == nil:
+			breaker.success()
+		case ctx.Err() == context.Canceled:
+			breaker.release() // the scrape was aborted, the endpoint was not tested
+		case ctx.Err() == context.DeadlineExceeded || retryable:
+			breaker.failure(config.CircuitBreakerThreshold)
+		default:
+			breaker.success()
+		}
+	}
+	return body, content, err
+}
+
+//doAPIRequest performs a single request. retryable is true if the request failed because rabbitmq is not available.
+func doAPIRequest(ctx context.Context, config rabbitExporterConfig, endpoint string) (body io.ReadCloser, content string, retryable bool, err error) {
 	var args string
 	enabled, exists := config.RabbitCapabilities[rabbitCapNoSort]
-	if enabled && exists {
+	if enabled && exists && !strings.Contains(endpoint, "sort=") { // paged requests are sorted
 		args = "?sort="
+		if strings.Contains(endpoint, "?") {
+			args = "&sort="
+		}
 	}
 
-	req, err := http.NewRequest("GET", config.RabbitURL+"/api/"+endpoint+args, nil)
+	req, err := newAPIRequest(ctx, config, endpoint+args, acceptContentType(config))
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "host": config.RabbitURL}).Error("Error while constructing rabbitHost request")
-		return nil, "", errors.New("Error while constructing rabbitHost request")
+		return nil, "", false, err
 	}
 
-	req.SetBasicAuth(config.RabbitUsername, config.RabbitPassword)
-	req.Header.Add("Accept", acceptContentType(config))
-
 	resp, err := client.Do(req)
 
 	if err != nil || resp == nil || resp.StatusCode != 200 {
 		status := 0
 		if resp != nil {
 			status = resp.StatusCode
+			resp.Body.Close()
 		}
 		log.WithFields(log.Fields{"error": err, "host": config.RabbitURL, "statusCode": status}).Error("Error while retrieving data from rabbitHost")
-		return nil, "", errors.New("Error while retrieving data from rabbitHost")
+		retryable = ctx.Err() == nil && (status == 0 || status == http.StatusTooManyRequests || status >= 500)
+		return nil, "", retryable, errors.New("Error while retrieving data from rabbitHost")
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	content := resp.Header.Get("Content-type")
+	body, err = responseBody(resp)
 	if err != nil {
-		return nil, "", err
+		resp.Body.Close()
+		return nil, "", ctx.Err() == nil, err
 	}
-	log.WithFields(log.Fields{"body": string(body), "endpoint": endpoint}).Debug("Metrics loaded")
+	return body, resp.Header.Get("Content-type"), false, nil
+}
+
+//newAPIRequest creates an authenticated request for the endpoint of the management api
+func newAPIRequest(ctx context.Context, config rabbitExporterConfig, endpoint string, accept string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", config.RabbitURL+"/api/"+endpoint, nil)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "host": config.RabbitURL}).Error("Error while constructing rabbitHost request")
+		return nil, errors.New("Error while constructing rabbitHost request")
+	}
+
+	req.SetBasicAuth(config.RabbitUsername, config.RabbitPassword)
+	req.Header.Add("Accept", accept)
+	req.Header.Add("Accept-Encoding", "gzip")
+	return req, nil
+}
+
+//healthCheckRequest requests a health check endpoint. A failed check is answered with status 503 and
+//the reason of the failure, so it is not handled as an error.
+func healthCheckRequest(ctx context.Context, config rabbitExporterConfig, endpoint string) (ok bool, reason string, err error) {
+	req, err := newAPIRequest(ctx, config, endpoint, "application/json")
+	if err != nil {
+		return false, "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "host": config.RabbitURL}).Error("Error while retrieving health check from rabbitHost")
+		return false, "", errors.New("Error while retrieving health check from rabbitHost")
+	}
+	defer resp.Body.Close()
 
-	return body, content, nil
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		log.WithFields(log.Fields{"host": config.RabbitURL, "endpoint": endpoint, "statusCode": resp.StatusCode}).Error("Error while retrieving health check from rabbitHost")
+		return false, "", fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		return false, "", err
+	}
+	var result struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return false, "", err
+	}
+	return result.Status == "ok", result.Reason, nil
 }
 
-func loadMetrics(config rabbitExporterConfig, endpoint string) (RabbitReply, error) {
-	body, content, err := apiRequest(config, endpoint)
+//responseBody returns the body of the response. It is decompressed while reading if rabbitmq used gzip.
+func responseBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	return MakeReply(content, body)
+	return gzipBody{reader, resp.Body}, nil
+}
+
+//gzipBody closes the decompressing reader together with the body of the response
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+//retryBackoff returns the time to wait before the next attempt: exponential backoff with full jitter
+func retryBackoff(config rabbitExporterConfig, attempt int) time.Duration {
+	backoff := time.Duration(config.APIRetryBackoff) * time.Millisecond << uint(attempt)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
 }
 
-func getStatsInfo(config rabbitExporterConfig, apiEndpoint string, labels []string) ([]StatsInfo, error) {
+func getStatsInfo(ctx context.Context, config rabbitExporterConfig, apiEndpoint string, labels []string) ([]StatsInfo, error) {
 	var q []StatsInfo
+	err := forEachStatsInfo(ctx, config, apiEndpoint, labels, func(statsinfo StatsInfo) {
+		q = append(q, statsinfo)
+	})
+	return q, err
+}
+
+//forEachStatsInfo requests a list of objects and calls fn for every object while the reply is decoded.
+//Json replies are decoded from the response, so a long list is never held in memory as a whole.
+func forEachStatsInfo(ctx context.Context, config rabbitExporterConfig, apiEndpoint string, labels []string, fn func(StatsInfo)) error {
+	_, err := decodeList(ctx, config, apiEndpoint, labels, false, fn)
+	return err
+}
+
+//decodeList requests a list of objects (or a page of it if paged is true), calls fn for every object and returns the number of pages.
+//Bert replies can only be decoded as a whole and are read completely before.
+func decodeList(ctx context.Context, config rabbitExporterConfig, apiEndpoint string, labels []string, paged bool, fn func(StatsInfo)) (int, error) {
+	body, content, err := openAPIRequest(ctx, config, apiEndpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	pageCount := 0
+	if content == "application/bert" {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := makeBERTReply(data)
+		if err != nil {
+			return 0, err
+		}
+		var items []StatsInfo
+		if paged {
+			items, pageCount = reply.MakePage(labels)
+		} else {
+			items = reply.MakeStatsInfo(labels)
+		}
+		for _, item := range items {
+			fn(item)
+		}
+		return pageCount, nil
+	}
 
-	reply, err := loadMetrics(config, apiEndpoint)
+	decoder := json.NewDecoder(body)
+	if paged {
+		pageCount, err = decodePage(decoder, labels, fn)
+	} else {
+		err = decodeStatsInfo(decoder, labels, fn)
+	}
 	if err != nil {
-		return q, err
+		log.WithFields(log.Fields{"error": err, "endpoint": apiEndpoint}).Error("Error while decoding json")
+	}
+	return pageCount, err
+}
+
+//getPagedStatsInfo requests the endpoint page by page if PAGE_SIZE is set. This limits the size of
+//each reply on clusters with many objects. If name is not empty, only objects with a name matching
+//the regex name are returned by rabbitmq. If the columns capability is enabled, only the fields
+//needed for columns are requested.
+//The pages are sorted by name. Objects which shift into the next page while walking the pages
+//are returned once.
+func getPagedStatsInfo(ctx context.Context, config rabbitExporterConfig, apiEndpoint string, labels []string, name string, columns []string) ([]StatsInfo, error) {
+	var q []StatsInfo
+	err := forEachPagedStatsInfo(ctx, config, apiEndpoint, labels, name, columns, func(statsinfo StatsInfo) {
+		q = append(q, statsinfo)
+	})
+	return q, err
+}
+
+//forEachPagedStatsInfo is getPagedStatsInfo calling fn for every object while the pages are decoded
+func forEachPagedStatsInfo(ctx context.Context, config rabbitExporterConfig, apiEndpoint string, labels []string, name string, columns []string, fn func(StatsInfo)) error {
+	query := url.Values{}
+	if isCapEnabled(config, rabbitCapColumns) && len(columns) > 0 {
+		query.Set("columns", columnsParameter(columns))
+	}
+
+	if config.PageSize <= 0 {
+		if len(query) > 0 {
+			apiEndpoint += "?" + query.Encode()
+		}
+		return forEachStatsInfo(ctx, config, apiEndpoint, labels, fn)
+	}
+
+	// vhost and name identify the objects, even if they are no labels of the module
+	pageLabels := append([]string{"vhost", "name"}, labels...)
+
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(config.PageSize))
+		query.Set("sort", "name")
+		if name != "" {
+			query.Set("name", name)
+			query.Set("use_regex", "true")
+		}
+
+		pageCount, err := decodeList(ctx, config, apiEndpoint+"?"+query.Encode(), pageLabels, true, func(item StatsInfo) {
+			key := item.labels["vhost"] + "/" + item.labels["name"]
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			fn(item)
+		})
+		if err != nil {
+			return err
+		}
+		if page >= pageCount {
+			break
+		}
+	}
+	return nil
+}
+
+//columnsParameter converts metric and label keys into the columns parameter of the management api.
+//Lengths of lists (slave_nodes_len) are computed from the list, queue arguments are requested as a whole.
+func columnsParameter(keys []string) string {
+	columns := map[string]bool{"name": true, "vhost": true} // objects are identified by vhost and name
+	for _, key := range keys {
+		if strings.HasPrefix(key, "arguments.") {
+			key = "arguments"
+		}
+		columns[strings.TrimSuffix(key, "_len")] = true
 	}
 
-	q = reply.MakeStatsInfo(labels)
+	result := make([]string, 0, len(columns))
+	for column := range columns {
+		result = append(result, column)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
 
-	return q, nil
+//serverSideFilter returns the pattern of the regex if rabbitmq can apply it as name filter.
+//Default and go specific patterns are filtered on the exporter only.
+func serverSideFilter(re *regexp.Regexp) string {
+	pattern := re.String()
+	if pattern == "" || pattern == ".*" {
+		return ""
+	}
+	for _, goSyntax := range []string{"(?", `\p`, `\P`, `\z`, `\Q`} {
+		if strings.Contains(pattern, goSyntax) {
+			return ""
+		}
+	}
+	return pattern
 }
 
-func getMetricMap(config rabbitExporterConfig, apiEndpoint string) (MetricMap, error) {
+func getMetricMap(ctx context.Context, config rabbitExporterConfig, apiEndpoint string) (MetricMap, error) {
 	var overview MetricMap
 
-	body, content, err := apiRequest(config, apiEndpoint)
+	body, content, err := apiRequest(ctx, config, apiEndpoint)
 	if err != nil {
 		return overview, err
 	}
@@ -1,9 +1,8 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	config2 "github.com/kbudde/rabbitmq_exporter/config"
-	"github.com/kbudde/rabbitmq_exporter/exporter"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -30,11 +29,11 @@ func TestGetMetricMap(t *testing.T) {
 	server := createTestserver(200, `{"nonFloat":"bob@example.com","float1":1.23456789101112,"number":2}`)
 	defer server.Close()
 
-	config := &config2.rabbitExporterConfig{
+	config := &rabbitExporterConfig{
 		RabbitURL: server.URL,
 	}
 
-	overview, _ := getMetricMap(*config, "overview")
+	overview, _ := getMetricMap(context.Background(), *config, "overview")
 
 	expect(t, len(overview), 2)
 	expect(t, overview["float1"], 1.23456789101112)
@@ -44,11 +43,11 @@ func TestGetMetricMap(t *testing.T) {
 	errorServer := createTestserver(500, http.StatusText(500))
 	defer errorServer.Close()
 
-	config = &config2.rabbitExporterConfig{
+	config = &rabbitExporterConfig{
 		RabbitURL: errorServer.URL,
 	}
 
-	overview, _ = getMetricMap(*config, "overview")
+	overview, _ = getMetricMap(context.Background(), *config, "overview")
 
 	expect(t, len(overview), 0)
 }
@@ -58,11 +57,11 @@ func TestQueues(t *testing.T) {
 	server := createTestserver(200, `[{"name":"Queue1","nonFloat":"bob@example.com","float1":1.23456789101112,"number":2},{"name":"Queue2","vhost":"Vhost2","nonFloat":"bob@example.com","float1":3.23456789101112,"number":3}]`)
 	defer server.Close()
 
-	config := &config2.rabbitExporterConfig{
+	config := &rabbitExporterConfig{
 		RabbitURL: server.URL,
 	}
 
-	queues, err := getStatsInfo(*config, "queues", exporter.queueLabelKeys)
+	queues, err := getStatsInfo(context.Background(), *config, "queues", queueLabelKeys)
 	expect(t, err, nil)
 	expect(t, len(queues), 2)
 	expect(t, queues[0].labels["name"], "Queue1")
@@ -80,11 +79,11 @@ func TestQueues(t *testing.T) {
 	errorServer := createTestserver(500, http.StatusText(500))
 	defer errorServer.Close()
 
-	config = &config2.rabbitExporterConfig{
+	config = &rabbitExporterConfig{
 		RabbitURL: errorServer.URL,
 	}
 
-	queues, err = getStatsInfo(*config, "queues", exporter.queueLabelKeys)
+	queues, err = getStatsInfo(context.Background(), *config, "queues", queueLabelKeys)
 	if err == nil {
 		t.Errorf("Request failed. An error was expected but not found")
 	}
@@ -94,14 +93,14 @@ func TestQueues(t *testing.T) {
 func TestExchanges(t *testing.T) {
 
 	// Test server that always responds with 200 code, and specific payload
-	server := createTestserver(200, exporter.exchangeAPIResponse)
+	server := createTestserver(200, exchangeAPIResponse)
 	defer server.Close()
 
-	config := &config2.rabbitExporterConfig{
+	config := &rabbitExporterConfig{
 		RabbitURL: server.URL,
 	}
 
-	exchanges, err := getStatsInfo(*config, "exchanges", exporter.exchangeLabelKeys)
+	exchanges, err := getStatsInfo(context.Background(), *config, "exchanges", exchangeLabelKeys)
 	expect(t, err, nil)
 	expect(t, len(exchanges), 9)
 	expect(t, exchanges[0].labels["name"], "")
@@ -122,11 +121,11 @@ func TestExchanges(t *testing.T) {
 	errorServer := createTestserver(500, http.StatusText(500))
 	defer errorServer.Close()
 
-	config = &config2.rabbitExporterConfig{
+	config = &rabbitExporterConfig{
 		RabbitURL: errorServer.URL,
 	}
 
-	exchanges, err = getStatsInfo(*config, "exchanges", exporter.exchangeLabels)
+	exchanges, err = getStatsInfo(context.Background(), *config, "exchanges", exchangeLabels)
 	if err == nil {
 		t.Errorf("Request failed. An error was expected but not found")
 	}
@@ -157,10 +156,58 @@ func assertNoSortRespected(t *testing.T, enabled bool) {
 	}))
 	defer server.Close()
 
-	config := &config2.rabbitExporterConfig{
+	config := &rabbitExporterConfig{
 		RabbitURL:          server.URL,
-		RabbitCapabilities: config2.rabbitCapabilitySet{config2.rabbitCapNoSort: enabled},
+		RabbitCapabilities: rabbitCapabilitySet{rabbitCapNoSort: enabled},
 	}
 
-	getMetricMap(*config, "overview")
+	getMetricMap(context.Background(), *config, "overview")
+}
+
+func TestPagedStatsInfoDuplicates(t *testing.T) {
+	// a connection opened while walking the pages shifts conn2 into the second page
+	pages := map[string]string{
+		"1": `{"items":[{"name":"conn1","vhost":"/","user":"a"},{"name":"conn2","vhost":"/","user":"a"}],"page_count":2}`,
+		"2": `{"items":[{"name":"conn2","vhost":"/","user":"a"},{"name":"conn2","vhost":"other","user":"b"}],"page_count":2}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sort := r.URL.Query()["sort"]; len(sort) != 1 || sort[0] != "name" {
+			t.Errorf("Expected paged request sorted by name. URI=%v", r.RequestURI)
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, pages[r.URL.Query().Get("page")])
+	}))
+	defer server.Close()
+
+	config := &rabbitExporterConfig{
+		RabbitURL:          server.URL,
+		RabbitCapabilities: rabbitCapabilitySet{rabbitCapNoSort: true},
+		PageSize:           2,
+	}
+
+	connections, err := getPagedStatsInfo(context.Background(), *config, "connections", []string{"vhost", "user"}, "", nil)
+	expect(t, err, nil)
+	expect(t, len(connections), 3)
+	expect(t, connections[2].labels["vhost"], "other")
+	expect(t, connections[2].labels["user"], "b")
+}
+
+func TestForEachStatsInfoStreams(t *testing.T) {
+	// the reply breaks off after the first queue
+	server := createTestserver(200, `[{"name":"Queue1","vhost":"/","messages":1},{"name":"Queue2","vhost":"/","mess`)
+	defer server.Close()
+
+	config := &rabbitExporterConfig{
+		RabbitURL: server.URL,
+	}
+
+	var names []string
+	err := forEachStatsInfo(context.Background(), *config, "queues", queueLabelKeys, func(queue StatsInfo) {
+		names = append(names, queue.labels["name"])
+	})
+	if err == nil {
+		t.Errorf("Expected an error for the incomplete reply")
+	}
+	expect(t, len(names), 1)
+	expect(t, names[0], "Queue1")
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var snapshotAgeDesc = newDesc("exporter_snapshot_age_seconds", "Seconds since the served metrics were scraped from rabbitmq. Only exported if background scraping is enabled.", nil)
+
+//snapshot holds the metrics of the last complete background scrape
+type snapshot struct {
+	mutex   sync.RWMutex
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+//startBackgroundScrape scrapes rabbitmq every interval until ctx is done.
+//Afterwards Collect serves the last complete snapshot instead of querying rabbitmq.
+func (e *exporter) startBackgroundScrape(ctx context.Context, interval time.Duration) {
+	e.snapshot = &snapshot{}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			e.updateSnapshot(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (e *exporter) updateSnapshot(ctx context.Context) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+	e.scrape(ctx, ch)
+	close(ch)
+	metrics := <-done
+	if ctx.Err() != nil { //scrape was cancelled, keep the last complete snapshot
+		return
+	}
+
+	e.snapshot.mutex.Lock()
+	e.snapshot.metrics = metrics
+	e.snapshot.time = time.Now()
+	e.snapshot.mutex.Unlock()
+	log.WithField("metrics", len(metrics)).Debug("Snapshot updated")
+}
+
+func (e *exporter) collectSnapshot(ch chan<- prometheus.Metric) {
+	e.snapshot.mutex.RLock()
+	defer e.snapshot.mutex.RUnlock()
+
+	if e.snapshot.time.IsZero() { //first scrape is not finished yet
+		return
+	}
+	for _, m := range e.snapshot.metrics {
+		ch <- m
+	}
+	ctx := e.newContext(context.Background())
+	ch <- mustNewConstMetric(&ctx, snapshotAgeDesc, prometheus.GaugeValue, time.Since(e.snapshot.time).Seconds())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+var moduleStaleDesc = newDesc("module_stale", "Are the metrics of the module from an earlier scrape because the last scrape of the module failed. Only exported if STALE_MAX_AGE is set.", []string{"cluster", "node", "module"})
+
+//staleCache keeps the output of the last successful collect of every module.
+//If a module fails, its last output is served instead as long as it is not older than maxAge.
+type staleCache struct {
+	mutex   sync.Mutex
+	maxAge  time.Duration
+	file    string
+	dirty   bool
+	modules map[string]moduleSnapshot
+}
+
+type moduleSnapshot struct {
+	time    time.Time
+	metrics []prometheus.Metric
+}
+
+//persistedModule is the format of a module snapshot on disk
+type persistedModule struct {
+	Time     time.Time           `json:"time"`
+	Families []*dto.MetricFamily `json:"families"`
+}
+
+//frozenMetric is a copy of a metric which does not change if the original metric is updated
+type frozenMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (m frozenMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m frozenMetric) Write(out *dto.Metric) error {
+	*out = *m.metric
+	return nil
+}
+
+//newStaleCache creates the cache and restores the snapshot saved in file, if there is one.
+func newStaleCache(maxAge time.Duration, file string) *staleCache {
+	c := &staleCache{
+		maxAge:  maxAge,
+		file:    file,
+		modules: make(map[string]moduleSnapshot),
+	}
+	if file != "" {
+		if err := c.load(); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", file).Warn("Loading stale metrics failed")
+		}
+	}
+	return c
+}
+
+//collect collects the module. The metrics are sent to ch after the module is finished.
+//If the module fails, the last successful output is sent and stale is true.
+func (c *staleCache) collect(ctx context.Context, name string, ex Exporter, ch chan<- prometheus.Metric) (stale bool, err error) {
+	buffer := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range buffer {
+			if frozen, err := freezeMetric(m); err == nil {
+				metrics = append(metrics, frozen)
+			} else {
+				log.WithError(err).WithField("module", name).Warn("Copying metric failed")
+			}
+		}
+		done <- metrics
+	}()
+	err = ex.Collect(ctx, buffer)
+	close(buffer)
+	metrics := <-done
+
+	c.mutex.Lock()
+	if err == nil {
+		c.modules[name] = moduleSnapshot{time: time.Now(), metrics: metrics}
+		c.dirty = true
+	} else {
+		last, ok := c.modules[name]
+		if ok && time.Since(last.time) <= c.maxAge {
+			metrics = last.metrics
+			stale = true
+		} else {
+			metrics = nil
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, m := range metrics {
+		ch <- m
+	}
+	return stale, err
+}
+
+func freezeMetric(m prometheus.Metric) (prometheus.Metric, error) {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		return nil, err
+	}
+	return frozenMetric{desc: m.Desc(), metric: &metric}, nil
+}
+
+//save writes the snapshot to the file, if anything changed since the last save
+func (c *staleCache) save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == "" || !c.dirty {
+		return nil
+	}
+
+	modules := make(map[string]persistedModule, len(c.modules))
+	for name, snapshot := range c.modules {
+		families, err := gatherMetrics(snapshot.metrics)
+		if err != nil {
+			return err
+		}
+		modules[name] = persistedModule{Time: snapshot.time, Families: families}
+	}
+	data, err := json.Marshal(modules)
+	if err != nil {
+		return err
+	}
+	tmpFile := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, c.file); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *staleCache) load() error {
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	var modules map[string]persistedModule
+	if err := json.Unmarshal(data, &modules); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name, module := range modules {
+		var metrics []prometheus.Metric
+		for _, family := range module.Families {
+			for _, metric := range family.Metric {
+				labelNames := make([]string, 0, len(metric.Label))
+				for _, label := range metric.Label {
+					labelNames = append(labelNames, label.GetName())
+				}
+				sort.Strings(labelNames)
+				desc := prometheus.NewDesc(family.GetName(), family.GetHelp(), labelNames, nil)
+				metrics = append(metrics, frozenMetric{desc: desc, metric: metric})
+			}
+		}
+		c.modules[name] = moduleSnapshot{time: module.Time, metrics: metrics}
+	}
+	log.WithFields(log.Fields{"file": c.file, "modules": len(modules)}).Info("Stale metrics loaded")
+	return nil
+}
+
+//metricsCollector is a collector for a fixed list of metrics
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+//gatherMetrics converts metrics into metric families, including name, help and type
+func gatherMetrics(metrics []prometheus.Metric) ([]*dto.MetricFamily, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metricsCollector(metrics)); err != nil {
+		return nil, err
+	}
+	return registry.Gather()
+}